@@ -0,0 +1,126 @@
+package agi
+
+import (
+	"crypto/subtle"
+	"log/slog"
+	"net"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// DefaultAuthTokenParam is the default query parameter from which a Server
+// reads the authentication token
+const DefaultAuthTokenParam = "token"
+
+// permitted reports whether a connection from the given address passes the
+// server's Allow and Deny lists.  Unix domain socket addresses are always
+// permitted; any other address which is not an IP address is refused.
+func (s *Server) permitted(addr net.Addr) bool {
+	if len(s.Allow) == 0 && len(s.Deny) == 0 {
+		return true
+	}
+	if _, ok := addr.(*net.UnixAddr); ok {
+		return true
+	}
+
+	ap, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return false
+	}
+	// Prefixes never contain addresses with zones
+	ip := ap.Addr().Unmap().WithZone("")
+
+	for _, p := range s.Deny {
+		if p.Contains(ip) {
+			return false
+		}
+	}
+	if len(s.Allow) == 0 {
+		return true
+	}
+	for _, p := range s.Allow {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// authenticate reports whether the given session presents the server's
+// AuthToken, if any.  The token is removed from the session's query values,
+// from the variables which carry it and from the header as recorded for
+// transcripts, so that handlers do not log it inadvertently.
+func (s *Server) authenticate(a *AGI) bool {
+	if s.AuthToken == "" {
+		return true
+	}
+
+	var token string
+	if s.AuthTokenArg > 0 {
+		name := "agi_arg_" + strconv.Itoa(s.AuthTokenArg)
+		if v, ok := a.Variables[name]; ok {
+			token = v
+			a.redact(name, "")
+		}
+	} else {
+		param := s.AuthTokenParam
+		if param == "" {
+			param = DefaultAuthTokenParam
+		}
+		token = a.Query().Get(param)
+		a.Query().Del(param)
+
+		for _, name := range []string{"agi_request", "agi_network_script"} {
+			if v, ok := a.Variables[name]; ok {
+				a.redact(name, stripQueryParam(v, param))
+			}
+		}
+	}
+
+	return subtle.ConstantTimeCompare([]byte(token), []byte(s.AuthToken)) == 1
+}
+
+// reject logs, reports and closes a connection refused at accept time
+func (s *Server) reject(conn net.Conn, event ConnEvent) {
+	s.logger().Warn("AGI connection rejected", slog.String("remote_addr", conn.RemoteAddr().String()), slog.String("reason", event.String()))
+	s.connEvent(conn, event)
+	conn.Close() // nolint: errcheck
+	s.connEvent(conn, ConnClosed)
+}
+
+// redact replaces the value of the given header variable, both in Variables
+// and in the header as recorded for transcripts
+func (a *AGI) redact(name, value string) {
+	a.Variables[name] = value
+
+	prefix := name + ":"
+	for i, e := range a.header {
+		if strings.HasPrefix(e.Line, prefix) {
+			a.header[i].Line = prefix + " " + value
+		}
+	}
+}
+
+// stripQueryParam removes the given parameter from the query, if any, of the
+// given URL or script path, leaving the rest as it was.
+func stripQueryParam(raw, param string) string {
+	base, query, ok := strings.Cut(raw, "?")
+	if !ok {
+		return raw
+	}
+
+	var kept []string
+	for _, pair := range strings.Split(query, "&") {
+		key, _, _ := strings.Cut(pair, "=")
+		if k, err := url.QueryUnescape(key); err == nil && k == param {
+			continue
+		}
+		kept = append(kept, pair)
+	}
+	if len(kept) == 0 {
+		return base
+	}
+	return base + "?" + strings.Join(kept, "&")
+}
@@ -0,0 +1,172 @@
+package agi
+
+import (
+	"bytes"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServerAllow(t *testing.T) {
+	var events connEvents
+	srv := &Server{
+		Handler:  HandlerFunc(verboseHandler),
+		Allow:    []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")},
+		ConnHook: events.hook,
+	}
+	c := dialServer(t, startServer(t, srv))
+	if !c.closed() {
+		t.Error("connection from outside Allow not closed")
+	}
+	if !events.has(ConnDenied) {
+		t.Error("denial not reported")
+	}
+
+	srv = &Server{
+		Handler: HandlerFunc(verboseHandler),
+		Allow:   []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")},
+	}
+	c = dialServer(t, startServer(t, srv))
+	if got := c.next("200 result=1"); got != "VERBOSE hello 1" {
+		t.Errorf("got %q from allowed connection", got)
+	}
+}
+
+func TestServerAuthToken(t *testing.T) {
+	type seen struct {
+		vars       map[string]string
+		query      string
+		transcript string
+	}
+	sessions := make(chan seen, 1)
+
+	var events connEvents
+	srv := &Server{
+		Handler: HandlerFunc(func(a *AGI) {
+			var buf bytes.Buffer
+			a.SetTranscript(&buf)
+			sessions <- seen{vars: a.Variables, query: a.Query().Encode(), transcript: buf.String()}
+		}),
+		AuthToken: "s3cret",
+		ConnHook:  events.hook,
+	}
+	addr := startServer(t, srv)
+
+	c := dialServer(t, addr,
+		"agi_request", "agi://pbx/ivr?lang=en&token=s3cret",
+		"agi_network_script", "ivr?lang=en&token=s3cret",
+	)
+	var s seen
+	select {
+	case s = <-sessions:
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler not called with a valid token")
+	}
+	c.closed()
+
+	if got := s.vars["agi_request"]; got != "agi://pbx/ivr?lang=en" {
+		t.Errorf("agi_request = %q", got)
+	}
+	if got := s.vars["agi_network_script"]; got != "ivr?lang=en" {
+		t.Errorf("agi_network_script = %q", got)
+	}
+	if s.query != "lang=en" {
+		t.Errorf("query = %q", s.query)
+	}
+	if strings.Contains(s.transcript, "s3cret") {
+		t.Errorf("token in transcript:\n%s", s.transcript)
+	}
+
+	// A wrong token is refused before the handler runs
+	c = dialServer(t, addr, "agi_network_script", "ivr?token=guess")
+	if !c.closed() {
+		t.Error("connection with wrong token not closed")
+	}
+	select {
+	case <-sessions:
+		t.Error("handler called with a wrong token")
+	default:
+	}
+	if !events.has(ConnUnauthorized) {
+		t.Error("unauthorized connection not reported")
+	}
+}
+
+func TestServerAuthTokenArg(t *testing.T) {
+	vars := make(chan map[string]string, 1)
+	srv := &Server{
+		Handler: HandlerFunc(func(a *AGI) {
+			vars <- a.Variables
+		}),
+		AuthToken:    "s3cret",
+		AuthTokenArg: 2,
+	}
+	addr := startServer(t, srv)
+
+	c := dialServer(t, addr, "agi_network_script", "ivr", "agi_arg_1", "sales", "agi_arg_2", "s3cret")
+	select {
+	case v := <-vars:
+		if v["agi_arg_1"] != "sales" || v["agi_arg_2"] != "" {
+			t.Errorf("arguments = %q, %q", v["agi_arg_1"], v["agi_arg_2"])
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler not called with a valid token")
+	}
+	c.closed()
+}
+
+func TestStripQueryParam(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"ivr", "ivr"},
+		{"ivr?token=x", "ivr"},
+		{"ivr?a=1&token=x&b=2", "ivr?a=1&b=2"},
+		{"ivr?tok%65n=x&b=%20", "ivr?b=%20"},
+		{"agi://pbx/ivr?tokens=x", "agi://pbx/ivr?tokens=x"},
+	}
+	for _, tt := range tests {
+		if got := stripQueryParam(tt.in, "token"); got != tt.want {
+			t.Errorf("stripQueryParam(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestPermitted(t *testing.T) {
+	srv := &Server{
+		Allow: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("fe80::/10")},
+		Deny:  []netip.Prefix{netip.MustParsePrefix("10.9.0.0/16"), netip.MustParsePrefix("fe80::bad/128")},
+	}
+	tcp := func(s string) net.Addr {
+		return net.TCPAddrFromAddrPort(netip.MustParseAddrPort(s))
+	}
+	pipe, _ := net.Pipe()
+	defer pipe.Close() // nolint: errcheck
+
+	tests := []struct {
+		addr net.Addr
+		want bool
+	}{
+		{tcp("10.1.2.3:4573"), true},
+		{tcp("10.9.2.3:4573"), false},
+		{tcp("192.0.2.1:4573"), false},
+		{tcp("[::ffff:10.1.2.3]:4573"), true},
+		{tcp("[fe80::1%eth0]:4573"), true},
+		{tcp("[fe80::bad%eth0]:4573"), false},
+		{&net.UnixAddr{Name: "/run/agi.sock", Net: "unix"}, true},
+		{pipe.RemoteAddr(), false},
+	}
+	for _, tt := range tests {
+		if got := srv.permitted(tt.addr); got != tt.want {
+			t.Errorf("permitted(%v) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+
+	// A zoned address is denied even when Allow is empty
+	srv = &Server{Deny: []netip.Prefix{netip.MustParsePrefix("fe80::/10")}}
+	if srv.permitted(tcp("[fe80::1%eth0]:4573")) {
+		t.Error("zoned link-local address passed Deny")
+	}
+}
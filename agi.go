@@ -2,15 +2,18 @@ package agi
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"io"
 	"log"
+	"log/slog"
 	"net"
+	"net/url"
 	"os"
-	"regexp"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/pkg/errors"
@@ -59,16 +62,127 @@ type AGI struct {
 	// of the AGI session.
 	Variables map[string]string
 
-	r    io.Reader
+	// r is the buffered reader which owns the inbound AGI stream for the
+	// lifetime of the session.  Nothing else may read from the underlying
+	// io.Reader once the session has been created, or buffered data will be
+	// lost.
+	r    *bufio.Reader
 	eagi io.Reader
-	w    io.Writer
+	w    *bufio.Writer
+
+	// wd is the underlying writer, if it supports write deadlines
+	wd writeDeadliner
 
 	conn net.Conn
 
+	// closed indicates that conn has been closed
+	closed atomic.Bool
+
+	// mu serializes commands
 	mu sync.Mutex
 
+	// werr is the error which left the outbound stream unusable, if any.  It
+	// is protected by mu.
+	werr error
+
+	// chs and spare are reused by successive commands, to save allocating
+	// them each time; protected by mu
+	chs   [1]chan reply
+	spare chan reply
+
+	// pmu protects pending, unclaimed and rerr
+	pmu sync.Mutex
+
+	// pending is the queue of commands awaiting a reply, oldest first
+	pending []chan reply
+
+	// unclaimed is the queue of replies which arrived while no command was
+	// awaiting one, oldest first
+	unclaimed []reply
+
+	// rerr is the error which terminated the read loop, if any
+	rerr error
+
+	// ctx is cancelled when the channel hangs up or the session input ends
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+
+	// version is the version of the connected Asterisk
+	version Version
+
+	// script and query are the parsed script request
+	script string
+	query  url.Values
+
+	// parmu protects params
+	parmu sync.Mutex
+
+	// params are the path parameters matched by a Mux
+	params map[string]string
+
+	// dead indicates that the channel has hung up, so that Asterisk will
+	// only accept a subset of commands
+	dead atomic.Bool
+
+	// hmu protects onHangup
+	hmu sync.Mutex
+
+	// onHangup is the set of callbacks to be run on hangup
+	onHangup []func()
+
+	// imu protects interceptors and observers
+	imu sync.Mutex
+
+	// interceptors wrap each command, outermost first
+	interceptors []Interceptor
+
+	// observers are told of each command once it completes, whether sent
+	// alone or in a batch
+	observers []observer
+
 	// Logging ability
 	logger *log.Logger
+
+	// Structured logging ability
+	slog *slog.Logger
+
+	// Tracing ability; protected by mu
+	tracer      Tracer
+	traceCtx    context.Context
+	lastCommand time.Time
+
+	// amu protects the activity fields
+	amu sync.Mutex
+
+	// inFlight is the number of commands awaiting replies
+	inFlight int
+
+	// lastActivity is the time the session started, or the last command
+	// started or completed
+	lastActivity time.Time
+
+	// lastVerb is the verb of the last command, started at lastVerbTime
+	lastVerb     string
+	lastVerbTime time.Time
+
+	// tmu protects traceSpan
+	tmu sync.Mutex
+
+	// traceSpan is the root span of the session
+	traceSpan Span
+
+	// header is the initial block of variables, as received
+	header []TranscriptEntry
+
+	// headerErr is the error which cut short the reading of the header, if
+	// any
+	headerErr error
+
+	// trmu protects transcript
+	trmu sync.Mutex
+
+	// transcript receives a copy of the wire conversation, if set
+	transcript io.Writer
 }
 
 // Response represents a response to an AGI
@@ -79,6 +193,14 @@ type Response struct {
 	Result       int    // Result is the numerical return (if parseable)
 	ResultString string // Result value as a string
 	Value        string // Value is the (optional) string value returned
+
+	// Data is the (optional) parenthesised data returned, such as
+	// "timeout" or the value of a variable.
+	Data string
+
+	// Attributes is the (optional) set of key=value pairs returned after the
+	// result and data, such as "endpos".
+	Attributes map[string]string
 }
 
 // Res returns the ResultString of a Response, as well as any error encountered.  Depending on the command, this is sometimes more useful than Val()
@@ -96,11 +218,96 @@ func (r *Response) Val() (string, error) {
 	return r.Value, r.Error
 }
 
-// Regex for AGI response result code and value
-var responseRegex = regexp.MustCompile(`^([\d]{3})\sresult=(\-?[[:alnum:]]*)(\s.*)?$`)
+// parseExtra splits the text following the result of a response into its
+// parenthesised data and its key=value attributes, as in
+// "(hangup) endpos=1234".  Since the data may itself contain parentheses and
+// spaces, it is taken to run up to the last closing parenthesis which is
+// followed only by attributes.
+func parseExtra(extra string) (data string, attrs map[string]string) {
+	rest := extra
+	if strings.HasPrefix(extra, "(") {
+		for i := len(extra) - 1; i > 0; i-- {
+			if extra[i] == ')' && isAttributes(extra[i+1:]) {
+				data = extra[1:i]
+				rest = extra[i+1:]
+				break
+			}
+		}
+	}
+
+	for _, field := range strings.Fields(rest) {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		if attrs == nil {
+			attrs = make(map[string]string)
+		}
+		attrs[kv[0]] = kv[1]
+	}
+	return
+}
+
+// isAttributes indicates whether the given text consists solely of
+// whitespace-separated key=value pairs.
+func isAttributes(s string) bool {
+	for _, field := range strings.Fields(s) {
+		if !strings.Contains(field, "=") {
+			return false
+		}
+	}
+	return true
+}
 
-// ErrHangup indicates the channel hung up during processing
-var ErrHangup = errors.New("hangup")
+// digit returns the DTMF digit encoded as a character code in the result, as
+// returned by commands such as STREAM FILE and WAIT FOR DIGIT, or the empty
+// string if there is none.
+func (r *Response) digit() string {
+	if r.Result > 0 && strconv.IsPrint(rune(r.Result)) {
+		return string(rune(r.Result))
+	}
+	return ""
+}
+
+// hungup reports whether the response carries a reply which failed because
+// the channel hung up.  The helpers return what such a reply carries along
+// with the error.
+func (r *Response) hungup() bool {
+	return r.Status != 0 && errors.Is(r.Error, ErrHangup)
+}
+
+// endPos returns the "endpos" attribute of the response, if any.
+func (r *Response) endPos() int64 {
+	pos, _ := strconv.ParseInt(r.Attributes["endpos"], 10, 64) // nolint: errcheck
+	return pos
+}
+
+// splitResult splits a reply line of the form "200 result=1 (data) k=v" into
+// its status code, result and any extra text following the result, reporting
+// whether the line has that form.
+func splitResult(line string) (status, result, extra string, ok bool) {
+	if len(line) < 4 || !isDigit(line[0]) || !isDigit(line[1]) || !isDigit(line[2]) || !isSpace(line[3]) {
+		return
+	}
+	rest, found := strings.CutPrefix(line[4:], "result=")
+	if !found {
+		return
+	}
+	for i := 0; i < len(rest); i++ {
+		if isSpace(rest[i]) {
+			return line[:3], rest[:i], rest[i:], true
+		}
+	}
+	return line[:3], rest, "", true
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\f' || c == '\r'
+}
 
 const (
 	// StatusOK indicates the AGI command was
@@ -115,13 +322,12 @@ const (
 	// cannot be performed on a dead (hungup) channel.
 	StatusDeadChannel = 511
 
-	// StatusEndUsage indicates...TODO
+	// StatusEndUsage indicates that Asterisk did not
+	// accept the syntax of the command.  It opens and
+	// closes a multi-line block of usage text.
 	StatusEndUsage = 520
 )
 
-// HandlerFunc is a function which accepts an AGI instance
-type HandlerFunc func(*AGI)
-
 // New creates an AGI session from the given reader and writer.
 func New(r io.Reader, w io.Writer) *AGI {
 	return NewWithEAGI(r, w, nil)
@@ -133,23 +339,39 @@ func New(r io.Reader, w io.Writer) *AGI {
 func NewWithEAGI(r io.Reader, w io.Writer, eagi io.Reader) *AGI {
 	a := AGI{
 		Variables: make(map[string]string),
-		r:         r,
-		w:         w,
+		r:         bufio.NewReader(r),
+		w:         bufio.NewWriter(w),
 		eagi:      eagi,
 	}
+	a.ctx, a.cancel = context.WithCancelCause(context.Background())
+	a.lastActivity = time.Now()
 
-	s := bufio.NewScanner(a.r)
-	for s.Scan() {
-		if s.Text() == "" {
+	for {
+		line, err := a.readLine()
+		if err != nil {
+			a.headerErr = err
+			break
+		}
+		a.header = append(a.header, TranscriptEntry{Time: time.Now(), Direction: FromAsterisk, Line: line})
+		if line == "" {
 			break
 		}
 
-		terms := strings.SplitN(s.Text(), ":", 2)
+		terms := strings.SplitN(line, ":", 2)
 		if len(terms) == 2 {
 			a.Variables[strings.TrimSpace(terms[0])] = strings.TrimSpace(terms[1])
 		}
 	}
 
+	a.version, _ = ParseVersion(a.Variables["agi_version"]) // nolint: errcheck
+	a.script, a.query = parseRequest(a.Variables)
+
+	if wd, ok := w.(writeDeadliner); ok {
+		a.wd = wd
+	}
+
+	go a.readLoop()
+
 	return &a
 }
 
@@ -171,34 +393,95 @@ func NewEAGI() *AGI {
 }
 
 // Listen binds an AGI HandlerFunc to the given TCP `host:port` address, creating a FastAGI service.
+// It is a shorthand for a Server with the given address and handler; use a Server directly for
+// graceful shutdown.
+//
+// As with any Server, the session is closed as soon as the handler returns, so a handler must not
+// hand its *AGI to another goroutine which outlives it.  A connection which does not send its
+// request header within DefaultHeaderTimeout is closed without calling the handler.
 func Listen(addr string, handler HandlerFunc) error {
-	if addr == "" {
-		addr = "localhost:4573"
+	return (&Server{Addr: addr, Handler: handler}).ListenAndServe()
+}
+
+// Close closes any network connection associated with the AGI instance
+func (a *AGI) Close() (err error) {
+	a.endTrace()
+
+	if a.conn != nil && a.closed.CompareAndSwap(false, true) {
+		err = a.conn.Close()
 	}
+	return
+}
 
-	l, err := net.Listen("tcp", addr)
-	if err != nil {
-		return errors.Wrap(err, "failed to bind server")
+// Done returns a channel which is closed when Asterisk signals that the
+// channel has hung up, or when the session's input ends.
+//
+// For FastAGI, Asterisk sends the hangup notice unless the AGISIGHUP channel
+// variable is set to "no".  For AGI over stdio, Asterisk signals the process
+// with SIGHUP instead, which this package does not handle.
+func (a *AGI) Done() <-chan struct{} {
+	return a.ctx.Done()
+}
+
+// Context returns a context which is cancelled when Asterisk signals that the
+// channel has hung up, or when the session's input ends.  The cause
+// (see context.Cause) is ErrHangup in the former case, or ErrIdleTimeout or
+// ErrSessionTimeout if a Server ended the session for exceeding its limits.
+// It is suitable for bounding work which is only useful while the caller is
+// still on the line.
+func (a *AGI) Context() context.Context {
+	return a.ctx
+}
+
+// OnHangup registers a function to be called when Asterisk signals that the
+// channel has hung up, or when the session's input ends.  Callbacks are run
+// in order, on their own goroutine.  If the session has already hung up, f is
+// called immediately (also on its own goroutine).
+func (a *AGI) OnHangup(f func()) {
+	a.hmu.Lock()
+	defer a.hmu.Unlock()
+
+	if a.ctx.Err() != nil {
+		go f()
+		return
 	}
-	defer l.Close() // nolint: errcheck
+	a.onHangup = append(a.onHangup, f)
+}
 
-	for {
-		conn, err := l.Accept()
-		if err != nil {
-			return errors.Wrap(err, "failed to accept TCP connection")
-		}
+// Dead indicates whether the session is running against a dead (hungup)
+// channel, as signalled by Asterisk either with a hangup notice or by
+// rejecting a command with StatusDeadChannel.  On a dead channel, Asterisk
+// only permits a subset of commands, including GET VARIABLE, SET VARIABLE,
+// EXEC, VERBOSE and the DATABASE commands.  Other known commands then fail
+// with ErrDeadChannel without being sent.
+func (a *AGI) Dead() bool {
+	return a.dead.Load()
+}
 
-		go handler(NewConn(conn))
+// hangup marks the session as hung up for the given cause, running any
+// registered hangup callbacks.  Only the first call has any effect.
+func (a *AGI) hangup(cause error) {
+	if cause == ErrHangup {
+		a.dead.Store(true)
 	}
-}
 
-// Close closes any network connection associated with the AGI instance
-func (a *AGI) Close() (err error) {
-	if a.conn != nil {
-		err = a.conn.Close()
-		a.conn = nil
+	a.hmu.Lock()
+	if a.ctx.Err() != nil {
+		a.hmu.Unlock()
+		return
+	}
+	a.cancel(cause)
+	callbacks := a.onHangup
+	a.onHangup = nil
+	a.hmu.Unlock()
+
+	if len(callbacks) > 0 {
+		go func() {
+			for _, f := range callbacks {
+				f()
+			}
+		}()
 	}
-	return
 }
 
 // EAGI enables access to the EAGI incoming stream (if available).
@@ -207,99 +490,224 @@ func (a *AGI) EAGI() io.Reader {
 }
 
 // Command sends the given command line to stdout
-// and returns the response.
-// TODO: this does not handle multi-line responses properly
-func (a *AGI) Command(cmd ...string) (resp *Response) {
-	resp = &Response{}
+// and returns the response.  The elements of cmd are
+// joined by spaces and sent as given; see EncodeArg.  Any error is a
+// *CommandError, which may be tested against
+// ErrInvalidCommand, ErrDeadChannel, ErrUsage,
+// ErrStatus, ErrUnsupported, ErrParse, ErrTransport,
+// ErrCanceled and ErrHangup using errors.Is.
+func (a *AGI) Command(cmd ...string) *Response {
+	return a.CommandContext(context.Background(), cmd...)
+}
+
+// CommandContext sends the given command line to Asterisk and returns the
+// response, giving up if ctx is done first.
+//
+// If ctx is done before the command is written, it is not sent at all.  If
+// ctx is done while waiting for the response, CommandContext returns at once
+// with an error wrapping ctx.Err().  Either way, the error is a *CommandError
+// of kind ErrCanceled.  Asterisk will still complete the
+// abandoned command before it processes the next one, and its response is
+// discarded when it arrives, so the session remains usable.
+//
+// The command passes through the session's interceptors (see Use) on its way
+// to Asterisk.
+func (a *AGI) CommandContext(ctx context.Context, cmd ...string) *Response {
 	cmdString := strings.Join(cmd, " ")
+
+	a.imu.Lock()
+	interceptors := a.interceptors
+	a.imu.Unlock()
+
+	if len(interceptors) == 0 {
+		return a.roundTrip(ctx, cmdString)
+	}
+	return chainInterceptors(interceptors, a.roundTrip)(ctx, cmdString)
+}
+
+// roundTrip sends the given command line to Asterisk and returns the response.
+func (a *AGI) roundTrip(ctx context.Context, cmdString string) (resp *Response) {
+	resp = &Response{}
 	var raw string
 
 	a.mu.Lock()
 	defer a.mu.Unlock()
 
-	// Logging raw command and answer
-	if a.logger != nil {
-		defer func() {
-			resString := ""
-			if resp.Error == nil {
-				resString += " Sta:" + strconv.Itoa(resp.Status)
-				resString += " Res:" + strconv.Itoa(resp.Result)
-				if resp.ResultString != "" {
-					resString += " Str:" + resp.ResultString
-				}
-				if resp.Value != "" {
-					resString += " Val:" + resp.Value
-				}
-			} else {
-				resString += " Err:" + resp.Error.Error()
-			}
-			resString = "{" + strings.TrimSpace(resString) + "}"
-			a.logger.Printf("#%s -> %s -> %s", cmdString, raw, resString)
-		}()
+	obs := a.observeCommand(ctx, cmdString)
+	defer func() {
+		obs.done(resp, raw)
+	}()
+
+	if err := a.checkSupported(cmdString); err != nil {
+		resp.Error = err
+		return
+	}
+	if err := a.checkDead(cmdString); err != nil {
+		resp.Error = err
+		return
 	}
 
-	_, err := a.w.Write([]byte(cmdString + "\n"))
+	chs, err := a.send(ctx, a.chs[:0], cmdString)
 	if err != nil {
-		resp.Error = errors.Wrap(err, "failed to send command")
+		resp.Error = err
 		return
 	}
 
-	s := bufio.NewScanner(a.r)
-	for s.Scan() {
-		raw = s.Text()
-		if raw == "" {
-			break
-		}
+	select {
+	case rep := <-chs[0]:
+		// The channel has been drained, so may be used again
+		a.spare = chs[0]
+		raw = a.receive(rep, resp)
+	case <-ctx.Done():
+		resp.Error = &CommandError{Kind: ErrCanceled, Err: errors.Wrap(ctx.Err(), "abandoned waiting for response")}
+	}
+	return
+}
 
-		if strings.HasPrefix(raw, "HANGUP") {
-			resp.Error = ErrHangup
-			return
+// receive parses the given reply into the given Response, returning the
+// first raw line of the reply.
+func (a *AGI) receive(rep reply, resp *Response) (raw string) {
+	if rep.err != nil {
+		resp.Error = &CommandError{Kind: ErrTransport, Err: errors.Wrap(rep.err, "failed to read response")}
+		return
+	}
+	raw = rep.lines[0]
+	parseResponse(rep.lines, resp)
+
+	if resp.Status == StatusDeadChannel {
+		a.dead.Store(true)
+	}
+
+	// A failure following a hangup is due to the hangup
+	if resp.Error == nil && resp.Result < 0 && a.ctx.Err() != nil {
+		resp.Error = &CommandError{Kind: ErrHangup, Status: resp.Status, Raw: raw}
+	}
+	return
+}
+
+// observation is the session's logging and tracing of a single command
+type observation struct {
+	a         *AGI
+	ctx       context.Context
+	cmdString string
+	span      Span
+	start     time.Time
+}
+
+// observeCommand starts the session's logging and tracing of the given
+// command.  Its done method is to be called with the response (and the first
+// raw line of the reply) once it is complete.  The caller must hold a.mu.
+func (a *AGI) observeCommand(ctx context.Context, cmdString string) observation {
+	o := observation{a: a, ctx: ctx, cmdString: cmdString, start: time.Now()}
+	if a.tracer != nil {
+		o.span = a.startCommandSpan(cmdString)
+	}
+	a.commandStarted(cmdString)
+	return o
+}
+
+// done completes the observation of the command with its response
+func (o observation) done(resp *Response, raw string) {
+	a := o.a
+	a.commandFinished()
+
+	// Logging raw command and answer
+	if a.logger != nil {
+		resString := ""
+		if resp.Error == nil {
+			resString += " Sta:" + strconv.Itoa(resp.Status)
+			resString += " Res:" + strconv.Itoa(resp.Result)
+			if resp.ResultString != "" {
+				resString += " Str:" + resp.ResultString
+			}
+			if resp.Value != "" {
+				resString += " Val:" + resp.Value
+			}
+		} else {
+			resString += " Err:" + resp.Error.Error()
 		}
+		resString = "{" + strings.TrimSpace(resString) + "}"
+		a.logger.Printf("#%s -> %s -> %s", o.cmdString, raw, resString)
+	}
 
-		// Parse and store the result code
-		pieces := responseRegex.FindStringSubmatch(raw)
-		if pieces == nil {
-			resp.Error = fmt.Errorf("failed to parse result: %s", raw)
-			return
+	if a.slog != nil {
+		a.logCommand(o.ctx, o.cmdString, resp, time.Since(o.start))
+	}
+
+	if o.span != nil {
+		a.endCommandSpan(o.span, resp)
+	}
+
+	a.imu.Lock()
+	observers := a.observers
+	a.imu.Unlock()
+	for _, f := range observers {
+		f(o.ctx, o.cmdString, resp, time.Since(o.start))
+	}
+}
+
+// parseResponse parses the lines of a single framed reply into the given
+// Response.
+func parseResponse(lines []string, resp *Response) {
+	raw := lines[0]
+
+	// A usage response is either a single "520 ..." line or a block opened
+	// by "520-..." and closed by "520 End of proper usage."
+	if strings.HasPrefix(raw, "520-") || (strings.HasPrefix(raw, "520 ") && !strings.Contains(raw, "result=")) {
+		resp.Status = StatusEndUsage
+		usage := &UsageError{}
+		if len(lines) > 2 {
+			usage.Usage = strings.Join(lines[1:len(lines)-1], "\n")
 		}
+		resp.Error = &CommandError{Kind: ErrUsage, Status: resp.Status, Raw: raw, Err: usage}
+		return
+	}
 
-		// Status code is the first substring
-		resp.Status, err = strconv.Atoi(pieces[1])
-		if err != nil {
-			resp.Error = errors.Wrap(err, "failed to get status code")
+	// Parse and store the result code
+	status, result, extra, ok := splitResult(raw)
+	if !ok {
+		// Statuses such as 510 carry no result
+		if status, err := strconv.Atoi(strings.SplitN(raw, " ", 2)[0]); err == nil && status != StatusOK {
+			resp.Status = status
+			resp.Error = &CommandError{Kind: statusKind(status), Status: status, Raw: raw}
 			return
 		}
+		resp.Error = &CommandError{Kind: ErrParse, Raw: raw}
+		return
+	}
 
-		// Result code is the second substring
-		resp.ResultString = pieces[2]
-		resp.Result, err = strconv.Atoi(pieces[2])
-		if err != nil {
-			resp.Error = errors.Wrap(err, "failed to parse result-code as an integer")
-		}
+	// Status code is the first substring
+	var err error
+	resp.Status, err = strconv.Atoi(status)
+	if err != nil {
+		resp.Error = &CommandError{Kind: ErrParse, Raw: raw, Err: errors.Wrap(err, "failed to get status code")}
+		return
+	}
 
-		// Value is the third (and optional) substring
-		wrappedVal := strings.TrimSpace(pieces[3])
-		resp.Value = strings.TrimSuffix(strings.TrimPrefix(wrappedVal, "("), ")")
+	// Result code is the second substring.  It is not always numeric (GET
+	// DATA, for instance, returns the received digits, which may be empty).
+	resp.ResultString = result
+	resp.Result, _ = strconv.Atoi(result) // nolint: errcheck
 
-		// FIXME: handle multiple line return values
-		break // nolint
-	}
+	// Value is the third (and optional) substring
+	wrappedVal := strings.TrimSpace(extra)
+	resp.Value = strings.TrimSuffix(strings.TrimPrefix(wrappedVal, "("), ")")
+	resp.Data, resp.Attributes = parseExtra(wrappedVal)
 
 	// If the Status code is not 200, return an error
-	if resp.Status != 200 {
-		resp.Error = fmt.Errorf("Non-200 status code")
+	if resp.Status != StatusOK {
+		resp.Error = &CommandError{Kind: statusKind(resp.Status), Status: resp.Status, Raw: raw}
 	}
-	return
 }
 
 // Answer answers the channel
 func (a *AGI) Answer() error {
-	return a.Command("ANSWER").Err()
+	return a.command(context.Background(), "ANSWER").Err()
 }
 
 // Status returns the channel status
 func (a *AGI) Status() (State, error) {
-	r, err := a.Command("CHANNEL STATUS").Res()
+	r, err := a.command(context.Background(), "CHANNEL STATUS").Res()
 	if err != nil {
 		return StateDown, err
 	}
@@ -310,29 +718,67 @@ func (a *AGI) Status() (State, error) {
 	return State(state), nil
 }
 
-// Exec runs a dialplan application
+// Exec runs a dialplan application.  The first element of cmd is the
+// name of the application; any further elements are its arguments, which
+// are joined with commas, as in the dialplan.
 func (a *AGI) Exec(cmd ...string) (string, error) {
-	cmd = append([]string{"EXEC"}, cmd...)
-	return a.Command(cmd...).Val()
+	return a.ExecContext(context.Background(), cmd...)
+}
+
+// ExecContext runs a dialplan application, giving up if ctx is done first.
+// See Exec for the meaning of cmd.
+func (a *AGI) ExecContext(ctx context.Context, cmd ...string) (string, error) {
+	if len(cmd) < 2 {
+		return a.command(ctx, "EXEC", cmd...).Val()
+	}
+	return a.command(ctx, "EXEC", cmd[0], strings.Join(cmd[1:], ",")).Val()
 }
 
 // Get gets the value of the given channel variable
 func (a *AGI) Get(key string) (string, error) {
-	return a.Command("GET VARIABLE", key).Val()
+	return a.GetContext(context.Background(), key)
+}
+
+// GetContext gets the value of the given channel variable, giving up if ctx is done first
+func (a *AGI) GetContext(ctx context.Context, key string) (string, error) {
+	return a.command(ctx, "GET VARIABLE", key).Val()
+}
+
+// GetDataResult describes the outcome of a GetData
+type GetDataResult struct {
+	// Digits is the set of DTMF digits received
+	Digits string
+
+	// Timeout indicates that input ended because the timeout expired
+	Timeout bool
+}
+
+// GetData plays a file and receives DTMF, returning the received digits.  If
+// the channel hangs up, the result is returned along with an error wrapping
+// ErrHangup.
+func (a *AGI) GetData(sound string, timeout time.Duration, maxdigits int) (*GetDataResult, error) {
+	return a.GetDataContext(context.Background(), sound, timeout, maxdigits)
 }
 
-// GetData plays a file and receives DTMF, returning the received digits
-func (a *AGI) GetData(sound string, timeout time.Duration, maxdigits int) (digits string, err error) {
+// GetDataContext plays a file and receives DTMF, returning the received digits.  It gives up if ctx is done first.
+func (a *AGI) GetDataContext(ctx context.Context, sound string, timeout time.Duration, maxdigits int) (*GetDataResult, error) {
 	if sound == "" {
 		sound = "silence/1"
 	}
-	resp := a.Command("GET DATA", sound, toMSec(timeout), strconv.Itoa(maxdigits))
-	return resp.Res()
+	resp := a.command(ctx, "GET DATA", sound, toMSec(timeout), strconv.Itoa(maxdigits))
+	if resp.Error != nil && !resp.hungup() {
+		return nil, resp.Error
+	}
+	res := &GetDataResult{Timeout: resp.Data == "timeout"}
+	if resp.Result >= 0 {
+		res.Digits = resp.ResultString
+	}
+	return res, resp.Error
 }
 
 // Hangup terminates the call
 func (a *AGI) Hangup() error {
-	return a.Command("HANGUP").Err()
+	return a.command(context.Background(), "HANGUP").Err()
 }
 
 // RecordOptions describes the options available when recording
@@ -356,8 +802,28 @@ type RecordOptions struct {
 	Offset int
 }
 
-// Record records audio to a file
-func (a *AGI) Record(name string, opts *RecordOptions) error {
+// RecordResult describes the outcome of a Record
+type RecordResult struct {
+	// Digit is the DTMF digit which ended the recording, if any
+	Digit string
+
+	// Reason is the reason the recording ended, as reported by Asterisk:
+	// "dtmf", "timeout" or "hangup", for instance.  It is empty if the
+	// recording ended due to silence.
+	Reason string
+
+	// EndPos is the offset, in samples, at which the recording ended
+	EndPos int64
+}
+
+// Record records audio to a file.  If the channel hangs up, the result is
+// returned along with an error wrapping ErrHangup.
+func (a *AGI) Record(name string, opts *RecordOptions) (*RecordResult, error) {
+	return a.RecordContext(context.Background(), name, opts)
+}
+
+// RecordContext records audio to a file, giving up if ctx is done first
+func (a *AGI) RecordContext(ctx context.Context, name string, opts *RecordOptions) (*RecordResult, error) {
 	if opts == nil {
 		opts = &RecordOptions{}
 	}
@@ -371,54 +837,49 @@ func (a *AGI) Record(name string, opts *RecordOptions) error {
 		opts.Timeout = 5 * time.Minute
 	}
 
-	cmd := strings.Join([]string{
-		"RECORD FILE ",
+	args := []string{
 		name,
 		opts.Format,
 		opts.EscapeDigits,
 		toMSec(opts.Timeout),
-	}, " ")
+	}
 
 	if opts.Offset > 0 {
-		cmd += " " + strconv.Itoa(opts.Offset)
+		args = append(args, strconv.Itoa(opts.Offset))
 	}
 
 	if opts.Beep {
-		cmd += " BEEP"
+		args = append(args, "BEEP")
 	}
 
 	if opts.Silence > 0 {
-		cmd += " s=" + toSec(opts.Silence)
+		args = append(args, "s="+toSec(opts.Silence))
 	}
 
-	return a.Command(cmd).Err()
+	resp := a.command(ctx, "RECORD FILE", args...)
+	if resp.Error != nil && !resp.hungup() {
+		return nil, resp.Error
+	}
+	return &RecordResult{
+		Digit:  resp.digit(),
+		Reason: resp.Data,
+		EndPos: resp.endPos(),
+	}, resp.Error
 }
 
 // SayAlpha plays a character string, annunciating each character.
 func (a *AGI) SayAlpha(label string, escapeDigits string) (digit string, err error) {
-	// NOTE: AGI needs empty double quotes hold the place of the empty value in the line
-	if escapeDigits == "" {
-		escapeDigits = `""`
-	}
-	return a.Command("SAY ALPHA", label, escapeDigits).Val()
+	return a.command(context.Background(), "SAY ALPHA", label, escapeDigits).Val()
 }
 
 // SayDigits plays a digit string, annunciating each digit.
 func (a *AGI) SayDigits(number string, escapeDigits string) (digit string, err error) {
-	// NOTE: AGI needs empty double quotes hold the place of the empty value in the line
-	if escapeDigits == "" {
-		escapeDigits = `""`
-	}
-	return a.Command("SAY DIGITS", number, escapeDigits).Val()
+	return a.command(context.Background(), "SAY DIGITS", number, escapeDigits).Val()
 }
 
 // SayDate plays a date
 func (a *AGI) SayDate(when time.Time, escapeDigits string) (digit string, err error) {
-	// NOTE: AGI needs empty double quotes hold the place of the empty value in the line
-	if escapeDigits == "" {
-		escapeDigits = `""`
-	}
-	return a.Command("SAY DATE", toEpoch(when), escapeDigits).Val()
+	return a.command(context.Background(), "SAY DATE", toEpoch(when), escapeDigits).Val()
 }
 
 // SayDateTime plays a date using the given format.  See `voicemail.conf` for the format syntax; defaults to `ABdY 'digits/at' IMp`.
@@ -426,64 +887,65 @@ func (a *AGI) SayDateTime(when time.Time, escapeDigits string, format string) (d
 	// Extract the timezone from the time
 	zone, _ := when.Zone()
 
-	// NOTE: AGI needs empty double quotes hold the place of the empty value in the line
-	if escapeDigits == "" {
-		escapeDigits = `""`
-	}
-
 	// Use the Asterisk default format if we are not given one
 	if format == "" {
 		format = "ABdY 'digits/at' IMp"
 	}
 
-	return a.Command("SAY DATETIME", toEpoch(when), escapeDigits, format, zone).Val()
+	return a.command(context.Background(), "SAY DATETIME", toEpoch(when), escapeDigits, format, zone).Val()
 }
 
 // SayNumber plays the given number.
 func (a *AGI) SayNumber(number string, escapeDigits string) (digit string, err error) {
-	// NOTE: AGI needs empty double quotes hold the place of the empty value in the line
-	if escapeDigits == "" {
-		escapeDigits = `""`
-	}
-	return a.Command("SAY NUMBER", number, escapeDigits).Val()
+	return a.command(context.Background(), "SAY NUMBER", number, escapeDigits).Val()
 }
 
 // SayPhonetic plays the given phrase phonetically
 func (a *AGI) SayPhonetic(phrase string, escapeDigits string) (digit string, err error) {
-	// NOTE: AGI needs empty double quotes hold the place of the empty value in the line
-	if escapeDigits == "" {
-		escapeDigits = `""`
-	}
-	return a.Command("SAY PHOENTIC", phrase, escapeDigits).Val()
+	return a.command(context.Background(), "SAY PHONETIC", phrase, escapeDigits).Val()
 }
 
 // SayTime plays the time part of the given timestamp
 func (a *AGI) SayTime(when time.Time, escapeDigits string) (digit string, err error) {
-	// NOTE: AGI needs empty double quotes hold the place of the empty value in the line
-	if escapeDigits == "" {
-		escapeDigits = `""`
-	}
-	return a.Command("SAY TIME", toEpoch(when), escapeDigits).Val()
+	return a.command(context.Background(), "SAY TIME", toEpoch(when), escapeDigits).Val()
 }
 
 // Set sets the given channel variable to
 // the provided value.
 func (a *AGI) Set(key, val string) error {
-	return a.Command("SET VARIABLE", key, val).Err()
+	return a.command(context.Background(), "SET VARIABLE", key, val).Err()
+}
+
+// StreamFileResult describes the outcome of a StreamFile
+type StreamFileResult struct {
+	// Digit is the DTMF digit which interrupted playback, if any
+	Digit string
+
+	// EndPos is the offset, in samples, at which playback ended
+	EndPos int64
+}
+
+// StreamFile plays the given file to the channel.  If the channel hangs up,
+// the result is returned along with an error wrapping ErrHangup.
+func (a *AGI) StreamFile(name string, escapeDigits string, offset int) (*StreamFileResult, error) {
+	return a.StreamFileContext(context.Background(), name, escapeDigits, offset)
 }
 
-// StreamFile plays the given file to the channel
-func (a *AGI) StreamFile(name string, escapeDigits string, offset int) (digit string, err error) {
-	// NOTE: AGI needs empty double quotes hold the place of the empty value in the line
-	if escapeDigits == "" {
-		escapeDigits = `""`
+// StreamFileContext plays the given file to the channel, giving up if ctx is done first
+func (a *AGI) StreamFileContext(ctx context.Context, name string, escapeDigits string, offset int) (*StreamFileResult, error) {
+	resp := a.command(ctx, "STREAM FILE", name, escapeDigits, strconv.Itoa(offset))
+	if resp.Error != nil && !resp.hungup() {
+		return nil, resp.Error
 	}
-	return a.Command("STREAM FILE", name, escapeDigits, strconv.Itoa(offset)).Val()
+	return &StreamFileResult{
+		Digit:  resp.digit(),
+		EndPos: resp.endPos(),
+	}, resp.Error
 }
 
 // Verbose logs the given message to the verbose message system
 func (a *AGI) Verbose(msg string, level int) error {
-	return a.Command("VERBOSE", strconv.Quote(msg), strconv.Itoa(level)).Err()
+	return a.command(context.Background(), "VERBOSE", msg, strconv.Itoa(level)).Err()
 }
 
 // Verbosef logs the formatted verbose output
@@ -493,10 +955,10 @@ func (a *AGI) Verbosef(format string, args ...interface{}) error {
 
 // WaitForDigit waits for a DTMF digit and returns what is received
 func (a *AGI) WaitForDigit(timeout time.Duration) (digit string, err error) {
-	resp := a.Command("WAIT FOR DIGIT", toMSec(timeout))
+	resp := a.command(context.Background(), "WAIT FOR DIGIT", toMSec(timeout))
 	resp.ResultString = ""
-	if resp.Error == nil && strconv.IsPrint(rune(resp.Result)) {
-		resp.ResultString = string(rune(resp.Result))
+	if resp.Error == nil {
+		resp.ResultString = resp.digit()
 	}
 	return resp.Res()
 }
@@ -0,0 +1,287 @@
+package agi
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// fakeAsterisk plays the Asterisk end of a FastAGI session over a net.Pipe
+type fakeAsterisk struct {
+	t    testing.TB
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// newFakeSession starts a FastAGI session whose header carries the given
+// variables, as name/value pairs, returning the session and the Asterisk end.
+func newFakeSession(t testing.TB, vars ...string) (*AGI, *fakeAsterisk) {
+	client, server := net.Pipe()
+	f := &fakeAsterisk{t: t, conn: server, r: bufio.NewReader(server)}
+
+	go func() {
+		header := "agi_network: yes\n"
+		for i := 0; i+1 < len(vars); i += 2 {
+			header += vars[i] + ": " + vars[i+1] + "\n"
+		}
+		server.Write([]byte(header + "\n")) // nolint: errcheck
+	}()
+
+	a := NewConn(client)
+	t.Cleanup(func() {
+		a.Close()      // nolint: errcheck
+		server.Close() // nolint: errcheck
+	})
+	return a, f
+}
+
+// expect reads the next command from the session and checks that it is want
+func (f *fakeAsterisk) expect(want string) {
+	f.t.Helper()
+
+	f.conn.SetReadDeadline(time.Now().Add(5 * time.Second)) // nolint: errcheck
+	line, err := f.r.ReadString('\n')
+	if err != nil {
+		f.t.Errorf("failed to read command %q: %v", want, err)
+		return
+	}
+	if got := strings.TrimSuffix(line, "\n"); got != want {
+		f.t.Errorf("got command %q, want %q", got, want)
+	}
+}
+
+// reply writes the given lines to the session
+func (f *fakeAsterisk) reply(lines ...string) {
+	f.t.Helper()
+
+	f.conn.SetWriteDeadline(time.Now().Add(5 * time.Second)) // nolint: errcheck
+	if _, err := f.conn.Write([]byte(strings.Join(lines, "\n") + "\n")); err != nil {
+		f.t.Errorf("failed to write reply: %v", err)
+	}
+}
+
+// serve answers every command with "200 result=1" until the session closes
+func (f *fakeAsterisk) serve() {
+	ok := []byte("200 result=1\n")
+	for {
+		if _, err := f.r.ReadSlice('\n'); err != nil {
+			return
+		}
+		if _, err := f.conn.Write(ok); err != nil {
+			return
+		}
+	}
+}
+
+func TestHeader(t *testing.T) {
+	a, _ := newFakeSession(t, "agi_channel", "SIP/test-00000001", "agi_network_script", "ivr/sales?lang=en")
+
+	if got := a.Variables["agi_channel"]; got != "SIP/test-00000001" {
+		t.Errorf("agi_channel = %q", got)
+	}
+	if got := a.Script(); got != "/ivr/sales" {
+		t.Errorf("Script() = %q", got)
+	}
+	if got := a.Query().Get("lang"); got != "en" {
+		t.Errorf("Query lang = %q", got)
+	}
+}
+
+func TestCommand(t *testing.T) {
+	a, f := newFakeSession(t)
+
+	go func() {
+		f.expect("STREAM FILE welcome \"\" 0")
+		f.reply("200 result=0 endpos=8000")
+		f.expect("GET DATA prompt 3000 4")
+		f.reply("200 result=12 (timeout)")
+	}()
+
+	res, err := a.StreamFile("welcome", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Digit != "" || res.EndPos != 8000 {
+		t.Errorf("StreamFile = %+v", res)
+	}
+
+	data, err := a.GetData("prompt", 3*time.Second, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data.Digits != "12" || !data.Timeout {
+		t.Errorf("GetData = %+v", data)
+	}
+}
+
+func TestCommandUsage(t *testing.T) {
+	a, f := newFakeSession(t)
+
+	go func() {
+		f.expect("DATABASE GET")
+		f.reply(
+			"520-Invalid command syntax.  Proper usage follows:",
+			"Usage: DATABASE GET <family> <key>",
+			"520 End of proper usage.",
+		)
+		f.expect("NOOP")
+		f.reply("200 result=0")
+	}()
+
+	err := a.Command("DATABASE GET").Err()
+	if !errors.Is(err, ErrUsage) {
+		t.Fatalf("got %v, want ErrUsage", err)
+	}
+	var usage *UsageError
+	if !errors.As(err, &usage) || usage.Usage != "Usage: DATABASE GET <family> <key>" {
+		t.Errorf("usage = %+v", usage)
+	}
+
+	// The session must still be in step
+	if err := a.Command("NOOP").Err(); err != nil {
+		t.Errorf("NOOP after usage error: %v", err)
+	}
+}
+
+func TestCommandStatus(t *testing.T) {
+	a, f := newFakeSession(t)
+
+	go func() {
+		f.expect("FOO")
+		f.reply("510 Invalid or unknown command")
+	}()
+
+	err := a.Command("FOO").Err()
+	if !errors.Is(err, ErrInvalidCommand) {
+		t.Fatalf("got %v, want ErrInvalidCommand", err)
+	}
+	var cerr *CommandError
+	if !errors.As(err, &cerr) || cerr.Status != StatusInvalid || cerr.Raw != "510 Invalid or unknown command" {
+		t.Errorf("CommandError = %+v", cerr)
+	}
+}
+
+func TestHangup(t *testing.T) {
+	a, f := newFakeSession(t)
+
+	called := make(chan struct{})
+	a.OnHangup(func() { close(called) })
+
+	go f.reply("HANGUP")
+
+	select {
+	case <-a.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("hangup not detected")
+	}
+	<-called
+
+	if cause := context.Cause(a.Context()); cause != ErrHangup {
+		t.Errorf("cause = %v, want ErrHangup", cause)
+	}
+	if !a.Dead() {
+		t.Error("session not marked dead")
+	}
+
+	// Commands not permitted on a dead channel fail without being sent
+	if err := a.Answer(); !errors.Is(err, ErrDeadChannel) {
+		t.Errorf("Answer on dead channel: got %v, want ErrDeadChannel", err)
+	}
+}
+
+func TestCommandContextCancel(t *testing.T) {
+	a, f := newFakeSession(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	sent := make(chan struct{})
+	go func() {
+		defer close(sent)
+		f.expect("WAIT FOR DIGIT 10000")
+	}()
+	err := a.CommandContext(ctx, "WAIT FOR DIGIT", "10000").Err()
+	var cerr *CommandError
+	if !errors.As(err, &cerr) || !errors.Is(err, ErrCanceled) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want a CommandError of kind ErrCanceled wrapping context.DeadlineExceeded", err)
+	}
+	<-sent
+
+	// A command whose context is already done is not sent
+	if err := a.CommandContext(ctx, "NOOP").Err(); !errors.As(err, &cerr) || !errors.Is(err, ErrCanceled) {
+		t.Fatalf("got %v, want a CommandError of kind ErrCanceled", err)
+	}
+
+	// The late reply to the abandoned command must not be taken as the reply
+	// to the next one
+	go func() {
+		f.reply("200 result=49")
+		f.expect("GET VARIABLE FOO")
+		f.reply("200 result=1 (bar)")
+	}()
+
+	val, err := a.Get("FOO")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val != "bar" {
+		t.Errorf("Get = %q, want %q", val, "bar")
+	}
+}
+
+func TestSessionEnd(t *testing.T) {
+	a, f := newFakeSession(t)
+
+	go func() {
+		f.expect("NOOP")
+		f.conn.Close() // nolint: errcheck
+	}()
+
+	if err := a.Command("NOOP").Err(); !errors.Is(err, ErrTransport) {
+		t.Errorf("got %v, want ErrTransport", err)
+	}
+	select {
+	case <-a.Done():
+	case <-time.After(5 * time.Second):
+		t.Error("session context not cancelled")
+	}
+}
+
+func BenchmarkCommand(b *testing.B) {
+	a, f := newFakeSession(b, "agi_channel", "SIP/test-00000001")
+	go f.serve()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := a.Command("VERBOSE", "hello", "1").Err(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestHangupResult(t *testing.T) {
+	a, f := newFakeSession(t)
+
+	// The hangup is signalled while the command is in flight, before its
+	// reply
+	go func() {
+		f.expect("RECORD FILE msg wav # 300000")
+		f.reply("HANGUP")
+		<-a.Done()
+		f.reply("200 result=-1 (hangup) endpos=16000")
+	}()
+
+	res, err := a.Record("msg", nil)
+	if !errors.Is(err, ErrHangup) {
+		t.Fatalf("got %v, want ErrHangup", err)
+	}
+	if res == nil || res.Reason != "hangup" || res.EndPos != 16000 || res.Digit != "" {
+		t.Errorf("Record = %+v", res)
+	}
+}
@@ -0,0 +1,207 @@
+package agi
+
+import (
+	"context"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Batch is a set of commands to be sent to Asterisk together, saving a round
+// trip per command.  Commands are queued with Command (or the helpers which
+// wrap it), each returning the Response which will be filled in once the
+// batch is run.
+//
+// Batched commands are logged, traced, recorded in the transcript and counted
+// by Metrics like any other.  Since interceptors see each command only as it
+// is sent and its response as it arrives, a session with interceptors
+// (including those of Server.Interceptors) runs its batches one command at a
+// time, each through the interceptors; only sessions without them save the
+// round trips.
+type Batch struct {
+	a     *AGI
+	lines []string
+	resps []*Response
+}
+
+// BatchError is returned by Batch.Run when a command of the batch fails
+type BatchError struct {
+	// Index is the position in the batch of the first command which failed
+	Index int
+
+	// Err is the error of that command
+	Err error
+}
+
+func (e *BatchError) Error() string {
+	return "batch command " + strconv.Itoa(e.Index) + " failed: " + e.Err.Error()
+}
+
+// Unwrap returns the error of the failed command
+func (e *BatchError) Unwrap() error {
+	return e.Err
+}
+
+// Batch returns a new, empty Batch of commands for the session
+func (a *AGI) Batch() *Batch {
+	return &Batch{a: a}
+}
+
+// Len returns the number of commands queued
+func (b *Batch) Len() int {
+	return len(b.lines)
+}
+
+// Command queues the given command line, as for AGI.Command, returning the
+// Response which will be filled in when the batch is run.
+func (b *Batch) Command(cmd ...string) *Response {
+	return b.queue(strings.Join(cmd, " "), nil)
+}
+
+// Set queues the setting of the given channel variable to the provided value
+func (b *Batch) Set(key, val string) *Response {
+	return b.command("SET VARIABLE", key, val)
+}
+
+// Get queues the retrieval of the given channel variable.  Its value will be
+// the Value of the returned Response.
+func (b *Batch) Get(key string) *Response {
+	return b.command("GET VARIABLE", key)
+}
+
+// Verbose queues the logging of the given message to the verbose message system
+func (b *Batch) Verbose(msg string, level int) *Response {
+	return b.command("VERBOSE", msg, strconv.Itoa(level))
+}
+
+// command encodes and queues the given command
+func (b *Batch) command(verb string, args ...string) *Response {
+	line, err := encodeCommand(verb, args)
+	if err != nil {
+		return b.queue(verb, &CommandError{Kind: ErrInvalidArgument, Err: err})
+	}
+	return b.queue(line, nil)
+}
+
+func (b *Batch) queue(line string, err error) *Response {
+	resp := &Response{Error: err}
+	b.lines = append(b.lines, line)
+	b.resps = append(b.resps, resp)
+	return resp
+}
+
+// Run writes all of the queued commands to Asterisk at once, then reads their
+// responses back in order, filling in the Response of each.  It returns a
+// *BatchError describing the first command to fail, if any.
+//
+// If any command could not be encoded, is not supported by the connected
+// Asterisk, or is not permitted on a dead channel (see AGI.Dead), nothing is
+// sent.  Otherwise, since all of the commands are written before any response
+// is read, Asterisk will run those following a failed command regardless;
+// their responses are recorded as usual.  If the session itself fails, or ctx
+// is done, partway through, the remaining commands are given that error and
+// any replies to them are discarded when they arrive, so the session stays
+// usable.
+//
+// If the session has interceptors, the commands are instead sent one at a
+// time, each through the interceptors, with the same outcome.
+func (b *Batch) Run(ctx context.Context) error {
+	for i, resp := range b.resps {
+		if resp.Error == nil {
+			resp.Error = b.a.checkSupported(b.lines[i])
+		}
+		if resp.Error == nil {
+			resp.Error = b.a.checkDead(b.lines[i])
+		}
+		if resp.Error != nil {
+			return &BatchError{Index: i, Err: resp.Error}
+		}
+	}
+	if len(b.lines) == 0 {
+		return nil
+	}
+
+	a := b.a
+	a.imu.Lock()
+	interceptors := a.interceptors
+	a.imu.Unlock()
+	if len(interceptors) > 0 {
+		return b.runEach(ctx, chainInterceptors(interceptors, a.roundTrip))
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	obs := make([]observation, len(b.lines))
+	for i, line := range b.lines {
+		obs[i] = a.observeCommand(ctx, line)
+	}
+
+	chs, err := a.send(ctx, nil, b.lines...)
+	if err != nil {
+		for i, resp := range b.resps {
+			resp.Error = err
+			obs[i].done(resp, "")
+		}
+		return &BatchError{Index: 0, Err: err}
+	}
+
+	var batchErr *BatchError
+	for i, ch := range chs {
+		resp := b.resps[i]
+
+		var raw string
+		select {
+		case rep := <-ch:
+			raw = a.receive(rep, resp)
+		case <-ctx.Done():
+			resp.Error = &CommandError{Kind: ErrCanceled, Err: errors.Wrap(ctx.Err(), "abandoned waiting for response")}
+		}
+		obs[i].done(resp, raw)
+
+		if resp.Error != nil && batchErr == nil {
+			batchErr = &BatchError{Index: i, Err: resp.Error}
+		}
+
+		// Once the session has failed, or we have given up, there is no
+		// point in waiting for the rest.
+		if resp.Error != nil && (errors.Is(resp.Error, ErrTransport) || ctx.Err() != nil) {
+			for j := i + 1; j < len(chs); j++ {
+				b.resps[j].Error = resp.Error
+				obs[j].done(b.resps[j], "")
+			}
+			break
+		}
+	}
+
+	if batchErr != nil {
+		return batchErr
+	}
+	return nil
+}
+
+// runEach runs the queued commands one at a time through the given Invoker,
+// filling in their Responses and stopping early as Run does.
+func (b *Batch) runEach(ctx context.Context, invoke Invoker) error {
+	var batchErr *BatchError
+	for i, line := range b.lines {
+		resp := b.resps[i]
+		*resp = *invoke(ctx, line)
+
+		if resp.Error != nil && batchErr == nil {
+			batchErr = &BatchError{Index: i, Err: resp.Error}
+		}
+		if resp.Error != nil && (errors.Is(resp.Error, ErrTransport) || ctx.Err() != nil) {
+			for j := i + 1; j < len(b.resps); j++ {
+				b.resps[j].Error = resp.Error
+			}
+			break
+		}
+	}
+
+	if batchErr != nil {
+		return batchErr
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package agi
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestBatch(t *testing.T) {
+	a, f := newFakeSession(t)
+
+	go func() {
+		// All commands are written before any reply is sent
+		f.expect("SET VARIABLE A 1")
+		f.expect(`SET VARIABLE B "two words"`)
+		f.expect("GET VARIABLE C")
+		f.reply("200 result=1", "200 result=1", "200 result=1 (three)")
+	}()
+
+	b := a.Batch()
+	setA := b.Set("A", "1")
+	setB := b.Set("B", "two words")
+	getC := b.Get("C")
+	if err := b.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if setA.Err() != nil || setB.Err() != nil {
+		t.Errorf("Set errors: %v, %v", setA.Err(), setB.Err())
+	}
+	if val, err := getC.Val(); err != nil || val != "three" {
+		t.Errorf("Get = %q, %v", val, err)
+	}
+}
+
+func TestBatchFailure(t *testing.T) {
+	a, f := newFakeSession(t)
+
+	go func() {
+		f.expect("SET VARIABLE A 1")
+		f.expect("FOO")
+		f.expect("SET VARIABLE B 2")
+		f.reply("200 result=1", "510 Invalid or unknown command", "200 result=1")
+		f.expect("NOOP")
+		f.reply("200 result=0")
+	}()
+
+	b := a.Batch()
+	b.Set("A", "1")
+	b.Command("FOO")
+	b.Set("B", "2")
+
+	err := b.Run(context.Background())
+	var berr *BatchError
+	if !errors.As(err, &berr) || berr.Index != 1 || !errors.Is(err, ErrInvalidCommand) {
+		t.Fatalf("got %v, want BatchError at 1 wrapping ErrInvalidCommand", err)
+	}
+
+	// Every reply was consumed, so the session is still in step
+	if err := a.Command("NOOP").Err(); err != nil {
+		t.Errorf("NOOP after batch: %v", err)
+	}
+}
+
+func TestBatchInvalidArgument(t *testing.T) {
+	a, _ := newFakeSession(t)
+
+	b := a.Batch()
+	b.Set("A", "1")
+	b.Set("B", "bad\nvalue")
+
+	err := b.Run(context.Background())
+	var berr *BatchError
+	if !errors.As(err, &berr) || berr.Index != 1 || !errors.Is(err, ErrInvalidArgument) {
+		t.Fatalf("got %v, want BatchError at 1 wrapping ErrInvalidArgument", err)
+	}
+}
+
+func TestBatchMetrics(t *testing.T) {
+	a, f := newFakeSession(t)
+
+	var m Metrics
+	m.Instrument(a)
+
+	go func() {
+		f.expect("SET VARIABLE A 1")
+		f.expect("SET VARIABLE B 2")
+		f.reply("200 result=1", "200 result=1")
+	}()
+
+	b := a.Batch()
+	b.Set("A", "1")
+	b.Set("B", "2")
+	if err := b.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if _, err := m.WriteTo(&out); err != nil {
+		t.Fatal(err)
+	}
+	want := `agi_command_responses_total{command="SET VARIABLE",status="200"} 2`
+	if !strings.Contains(out.String(), want) {
+		t.Errorf("metrics missing %q:\n%s", want, out.String())
+	}
+}
+
+func TestBatchInterceptors(t *testing.T) {
+	a, f := newFakeSession(t)
+
+	var seen []string
+	a.Use(func(ctx context.Context, cmd string, next Invoker) *Response {
+		seen = append(seen, cmd)
+		return next(ctx, strings.Replace(cmd, "s3cret", "xxx", 1))
+	})
+
+	go func() {
+		// Commands arrive as altered by the interceptor
+		f.expect("SET VARIABLE PIN xxx")
+		f.reply("200 result=1")
+		f.expect("FOO")
+		f.reply("510 Invalid or unknown command")
+		f.expect("GET VARIABLE C")
+		f.reply("200 result=1 (three)")
+	}()
+
+	b := a.Batch()
+	set := b.Set("PIN", "s3cret")
+	b.Command("FOO")
+	get := b.Get("C")
+
+	err := b.Run(context.Background())
+	var berr *BatchError
+	if !errors.As(err, &berr) || berr.Index != 1 || !errors.Is(err, ErrInvalidCommand) {
+		t.Fatalf("got %v, want BatchError at 1 wrapping ErrInvalidCommand", err)
+	}
+	if set.Err() != nil {
+		t.Errorf("Set: %v", set.Err())
+	}
+	if val, err := get.Val(); err != nil || val != "three" {
+		t.Errorf("Get = %q, %v", val, err)
+	}
+	if len(seen) != 3 {
+		t.Errorf("interceptor saw %q", seen)
+	}
+}
@@ -0,0 +1,120 @@
+package agi
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// commandSpec describes an AGI command known to Asterisk
+type commandSpec struct {
+	// allowedDead indicates that Asterisk permits the command on a dead
+	// (hungup) channel
+	allowedDead bool
+
+	// args lists those arguments which not every release of Asterisk that
+	// reports its version accepts
+	args []argSince
+}
+
+// argSince records the first release of Asterisk to accept an argument of a
+// command
+type argSince struct {
+	// index is the position of the argument, counting from zero after the
+	// command itself
+	index int
+
+	// name is the name of the argument, as in the Asterisk documentation
+	name string
+
+	// since is the first release to accept the argument
+	since Version
+}
+
+// commandSpecs is the set of AGI commands known to Asterisk.  Several
+// commands share a first word, so the command of a line is the longest of
+// these which prefixes it.
+var commandSpecs = map[string]commandSpec{
+	"ANSWER":                    {},
+	"ASYNCAGI BREAK":            {allowedDead: true},
+	"CHANNEL STATUS":            {},
+	"CONTROL STREAM FILE":       {args: []argSince{{index: 6, name: "offsetms", since: version12}}},
+	"DATABASE DEL":              {allowedDead: true},
+	"DATABASE DELTREE":          {allowedDead: true},
+	"DATABASE GET":              {allowedDead: true},
+	"DATABASE PUT":              {allowedDead: true},
+	"EXEC":                      {allowedDead: true},
+	"GET DATA":                  {},
+	"GET FULL VARIABLE":         {allowedDead: true},
+	"GET OPTION":                {},
+	"GET VARIABLE":              {allowedDead: true},
+	"GOSUB":                     {},
+	"HANGUP":                    {},
+	"NOOP":                      {allowedDead: true},
+	"RECEIVE CHAR":              {},
+	"RECEIVE TEXT":              {},
+	"RECORD FILE":               {},
+	"SAY ALPHA":                 {},
+	"SAY DATE":                  {},
+	"SAY DATETIME":              {},
+	"SAY DIGITS":                {},
+	"SAY NUMBER":                {},
+	"SAY PHONETIC":              {},
+	"SAY TIME":                  {},
+	"SEND IMAGE":                {},
+	"SEND TEXT":                 {},
+	"SET AUTOHANGUP":            {},
+	"SET CALLERID":              {},
+	"SET CONTEXT":               {},
+	"SET EXTENSION":             {},
+	"SET MUSIC":                 {},
+	"SET PRIORITY":              {},
+	"SET VARIABLE":              {allowedDead: true},
+	"SPEECH ACTIVATE GRAMMAR":   {},
+	"SPEECH CREATE":             {},
+	"SPEECH DEACTIVATE GRAMMAR": {},
+	"SPEECH DESTROY":            {},
+	"SPEECH LOAD GRAMMAR":       {},
+	"SPEECH RECOGNIZE":          {},
+	"SPEECH SET":                {},
+	"SPEECH UNLOAD GRAMMAR":     {},
+	"STREAM FILE":               {},
+	"TDD MODE":                  {},
+	"VERBOSE":                   {allowedDead: true},
+	"WAIT FOR DIGIT":            {},
+}
+
+// commandVerb returns the AGI command (such as "GET VARIABLE") of the given
+// command line, without its arguments.  Unknown commands are taken to be the
+// first word of the line.
+func commandVerb(line string) string {
+	var verb string
+	for v := range commandSpecs {
+		if len(v) > len(verb) && len(line) >= len(v) && strings.EqualFold(line[:len(v)], v) && (len(line) == len(v) || line[len(v)] == ' ') {
+			verb = v
+		}
+	}
+	if verb != "" {
+		return verb
+	}
+
+	if i := strings.IndexByte(line, ' '); i >= 0 {
+		line = line[:i]
+	}
+	return strings.ToUpper(line)
+}
+
+// checkDead returns an error if the session is running against a dead channel
+// and the given command line is a known command which Asterisk does not
+// permit there.
+func (a *AGI) checkDead(line string) error {
+	if !a.dead.Load() {
+		return nil
+	}
+
+	verb := commandVerb(line)
+	if spec, ok := commandSpecs[verb]; !ok || spec.allowedDead {
+		return nil
+	}
+	return &CommandError{Kind: ErrDeadChannel, Err: errors.New(verb)}
+}
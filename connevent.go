@@ -0,0 +1,61 @@
+package agi
+
+import (
+	"net"
+)
+
+// ConnEvent is a step in the life of a connection to a Server, as reported to
+// Server.ConnHook
+type ConnEvent int
+
+const (
+	// ConnAccepted is reported when a connection is accepted
+	ConnAccepted ConnEvent = iota
+
+	// ConnDenied is reported when a connection is refused by the server's
+	// Allow or Deny lists
+	ConnDenied
+
+	// ConnHandshakeFailed is reported when the TLS handshake of a
+	// connection fails
+	ConnHandshakeFailed
+
+	// ConnUnauthorized is reported when a session does not present the
+	// server's AuthToken
+	ConnUnauthorized
+
+	// ConnOverloaded is reported when a session arrives while MaxSessions
+	// sessions are active, and is refused or passed to the OverloadHandler
+	ConnOverloaded
+
+	// ConnClosed is reported when the server closes a connection, for
+	// whatever reason.  It is reported exactly once for every accepted
+	// connection.
+	ConnClosed
+)
+
+// String returns the name of the event, as used in metric labels
+func (e ConnEvent) String() string {
+	switch e {
+	case ConnAccepted:
+		return "accepted"
+	case ConnDenied:
+		return "denied"
+	case ConnHandshakeFailed:
+		return "handshake_failed"
+	case ConnUnauthorized:
+		return "unauthorized"
+	case ConnOverloaded:
+		return "overloaded"
+	case ConnClosed:
+		return "closed"
+	}
+	return "unknown"
+}
+
+// connEvent reports the given event to the server's ConnHook, if any
+func (s *Server) connEvent(conn net.Conn, event ConnEvent) {
+	if s.ConnHook != nil {
+		s.ConnHook(conn, event)
+	}
+}
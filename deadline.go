@@ -0,0 +1,100 @@
+package agi
+
+import (
+	"log/slog"
+	"time"
+)
+
+// commandStarted records the start of the given command
+func (a *AGI) commandStarted(cmd string) {
+	a.amu.Lock()
+	defer a.amu.Unlock()
+
+	a.inFlight++
+	a.lastActivity = time.Now()
+	a.lastVerb = commandVerb(cmd)
+	a.lastVerbTime = a.lastActivity
+}
+
+// commandFinished records the completion of a command
+func (a *AGI) commandFinished() {
+	a.amu.Lock()
+	defer a.amu.Unlock()
+
+	a.inFlight--
+	a.lastActivity = time.Now()
+}
+
+// idle returns how long the session has gone without a command in flight,
+// which is zero while one is, even if Asterisk never replies.
+func (a *AGI) idle() time.Duration {
+	a.amu.Lock()
+	defer a.amu.Unlock()
+
+	if a.inFlight > 0 {
+		return 0
+	}
+	return time.Since(a.lastActivity)
+}
+
+// watchDeadlines enforces the server's IdleTimeout and MaxSessionDuration on
+// the given session, which must be tracked, returning a function which stops
+// doing so.
+func (s *Server) watchDeadlines(a *AGI) (stop func()) {
+	if s.IdleTimeout <= 0 && s.MaxSessionDuration <= 0 {
+		return func() {}
+	}
+
+	s.mu.Lock()
+	start := s.sessions[a].info.Start
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		var total, idle <-chan time.Time
+		if s.MaxSessionDuration > 0 {
+			t := time.NewTimer(s.MaxSessionDuration - time.Since(start))
+			defer t.Stop()
+			total = t.C
+		}
+
+		var idleTimer *time.Timer
+		if s.IdleTimeout > 0 {
+			idleTimer = time.NewTimer(s.IdleTimeout)
+			defer idleTimer.Stop()
+			idle = idleTimer.C
+		}
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-total:
+				s.expire(a, ErrSessionTimeout)
+				return
+			case <-idle:
+				if d := a.idle(); d < s.IdleTimeout {
+					idleTimer.Reset(s.IdleTimeout - d)
+					continue
+				}
+				s.expire(a, ErrIdleTimeout)
+				return
+			}
+		}
+	}()
+
+	return func() { close(done) }
+}
+
+// expire ends the given session for exceeding one of the server's limits.
+// The connection is closed even if the session's context is already done, as
+// it is after a hangup, so that a handler which does not return cannot hold
+// it open.
+func (s *Server) expire(a *AGI, cause error) {
+	s.logger().Warn("AGI session timed out", append(s.sessionAttrs(a), slog.String("error", cause.Error()))...)
+
+	if a.ctx.Err() == nil {
+		a.hangup(cause)
+	}
+	a.Close() // nolint: errcheck
+}
@@ -0,0 +1,128 @@
+package agi
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// sessionCause starts srv with a handler which waits for its session to end,
+// returning the address and a channel which receives the cause.
+func sessionCause(t *testing.T, srv *Server, handler func(a *AGI)) (string, <-chan error) {
+	t.Helper()
+
+	causes := make(chan error, 1)
+	srv.Handler = HandlerFunc(func(a *AGI) {
+		if handler != nil {
+			handler(a)
+		}
+		<-a.Done()
+		causes <- context.Cause(a.Context())
+	})
+	return startServer(t, srv), causes
+}
+
+func waitCause(t *testing.T, causes <-chan error, want error) {
+	t.Helper()
+
+	select {
+	case cause := <-causes:
+		if cause != want {
+			t.Errorf("cause = %v, want %v", cause, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("session not ended with %v", want)
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	addr, causes := sessionCause(t, &Server{IdleTimeout: 50 * time.Millisecond}, func(a *AGI) {
+		// Activity postpones the timeout
+		for i := 0; i < 3; i++ {
+			time.Sleep(30 * time.Millisecond)
+			a.Command("NOOP") // nolint: errcheck
+		}
+	})
+
+	c := dialServer(t, addr)
+	for i := 0; i < 3; i++ {
+		if got := c.next("200 result=0"); got != "NOOP" {
+			t.Fatalf("got %q; session timed out while active", got)
+		}
+	}
+	waitCause(t, causes, ErrIdleTimeout)
+	if !c.closed() {
+		t.Error("idle session not closed")
+	}
+}
+
+func TestIdleTimeoutInFlight(t *testing.T) {
+	// An unanswered command is not idle, so only MaxSessionDuration ends
+	// the session.
+	srv := &Server{
+		IdleTimeout:        20 * time.Millisecond,
+		MaxSessionDuration: 300 * time.Millisecond,
+	}
+	addr, causes := sessionCause(t, srv, func(a *AGI) {
+		a.Command("WAIT FOR DIGIT", "-1") // nolint: errcheck
+	})
+
+	c := dialServer(t, addr)
+	if got := c.next(""); got != "WAIT FOR DIGIT -1" {
+		t.Fatalf("got %q", got)
+	}
+	waitCause(t, causes, ErrSessionTimeout)
+}
+
+func TestMaxSessionDurationFromAccept(t *testing.T) {
+	srv := &Server{MaxSessionDuration: 400 * time.Millisecond}
+	addr, causes := sessionCause(t, srv, nil)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close() // nolint: errcheck
+
+	waitFor(t, "connection", func() bool { return srv.openSessions() == 1 })
+	time.Sleep(300 * time.Millisecond)
+	sent := time.Now()
+	if _, err := conn.Write([]byte("agi_network: yes\n\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, "session", func() bool { return len(srv.Sessions()) == 1 })
+	if start := srv.Sessions()[0].Start; !start.Before(sent.Add(-250 * time.Millisecond)) {
+		t.Errorf("session start is %v from its header, want the time of accept", start.Sub(sent))
+	}
+
+	waitCause(t, causes, ErrSessionTimeout)
+	if d := time.Since(sent); d >= 300*time.Millisecond {
+		t.Errorf("session lasted %v after its header; want the duration counted from accept", d)
+	}
+}
+
+func TestDeadlinesAfterHangup(t *testing.T) {
+	for name, srv := range map[string]*Server{
+		"IdleTimeout":        {IdleTimeout: 50 * time.Millisecond},
+		"MaxSessionDuration": {MaxSessionDuration: 100 * time.Millisecond},
+	} {
+		stuck := make(chan struct{})
+		defer close(stuck)
+
+		hungup := make(chan struct{})
+		srv.Handler = HandlerFunc(func(a *AGI) {
+			<-a.Done()
+			close(hungup)
+			<-stuck // a handler which never returns
+		})
+		c := dialServer(t, startServer(t, srv))
+
+		c.conn.Write([]byte("HANGUP\n")) // nolint: errcheck
+		<-hungup
+		if !c.closed() {
+			t.Errorf("%s did not close the connection after hangup", name)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package agi
+
+import (
+	"context"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// EncodeArg encodes a single command argument the way the Asterisk AGI parser
+// expects.  Arguments which are empty or which contain whitespace, quotes or
+// backslashes are double-quoted, with any quotes and backslashes within them
+// escaped by a backslash.  Other arguments are returned unchanged.
+//
+// Line breaks and NUL characters cannot be encoded, since they would end the
+// command line; an error wrapping ErrInvalidArgument is returned for them.
+//
+// Command sends its arguments as given, so callers passing untrusted values
+// to Command should encode them with EncodeArg first.  The helpers of this
+// package do so themselves.
+func EncodeArg(arg string) (string, error) {
+	enc, err := encodeArg(arg)
+	if err != nil {
+		return "", errors.Wrap(ErrInvalidArgument, err.Error())
+	}
+	return enc, nil
+}
+
+// encodeArg implements EncodeArg, returning an unclassified error.
+func encodeArg(arg string) (string, error) {
+	if strings.ContainsAny(arg, "\r\n\x00") {
+		return "", errors.Errorf("argument %q contains a line break or NUL", arg)
+	}
+	if arg != "" && !strings.ContainsAny(arg, " \t\"\\") {
+		return arg, nil
+	}
+
+	return quote(arg), nil
+}
+
+// quote double-quotes the given text, escaping any quotes and backslashes
+// within it with a backslash.  Both the AGI command parser and the dialplan
+// application argument parser understand this form, so it also keeps commas
+// and quotes within an argument to an application run by EXEC from splitting
+// it into several application arguments; the result is then encoded again,
+// as part of the EXEC command, when it is sent.
+func quote(arg string) string {
+	var b strings.Builder
+	b.Grow(len(arg) + 2)
+	b.WriteByte('"')
+	for i := 0; i < len(arg); i++ {
+		if arg[i] == '"' || arg[i] == '\\' {
+			b.WriteByte('\\')
+		}
+		b.WriteByte(arg[i])
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// encodeCommand builds a command line from the given (unencoded) command verb
+// and the encoded forms of the given arguments.
+func encodeCommand(verb string, args []string) (string, error) {
+	var b strings.Builder
+	b.WriteString(verb)
+	for _, arg := range args {
+		enc, err := encodeArg(arg)
+		if err != nil {
+			return "", err
+		}
+		b.WriteByte(' ')
+		b.WriteString(enc)
+	}
+	return b.String(), nil
+}
+
+// command encodes the given arguments and sends them, following the given
+// command verb (such as "GET VARIABLE"), to Asterisk.
+func (a *AGI) command(ctx context.Context, verb string, args ...string) *Response {
+	line, err := encodeCommand(verb, args)
+	if err != nil {
+		return &Response{Error: &CommandError{Kind: ErrInvalidArgument, Err: err}}
+	}
+	return a.CommandContext(ctx, line)
+}
@@ -0,0 +1,84 @@
+package agi
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestEncodeArg(t *testing.T) {
+	for _, tt := range []struct {
+		in, want string
+	}{
+		{"plain", "plain"},
+		{"", `""`},
+		{"two words", `"two words"`},
+		{"tab\there", "\"tab\there\""},
+		{`say "hi"`, `"say \"hi\""`},
+		{`back\slash`, `"back\\slash"`},
+	} {
+		got, err := EncodeArg(tt.in)
+		if err != nil {
+			t.Errorf("EncodeArg(%q): %v", tt.in, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("EncodeArg(%q) = %s, want %s", tt.in, got, tt.want)
+		}
+	}
+
+	for _, in := range []string{"line\nbreak", "carriage\rreturn", "nul\x00"} {
+		if _, err := EncodeArg(in); !errors.Is(err, ErrInvalidArgument) {
+			t.Errorf("EncodeArg(%q): got %v, want ErrInvalidArgument", in, err)
+		}
+	}
+}
+
+func TestSetInjection(t *testing.T) {
+	a, f := newFakeSession(t)
+
+	go func() {
+		f.expect(`SET VARIABLE NAME "x\" 1\\"`)
+		f.reply("200 result=1")
+	}()
+
+	if err := a.Set("NAME", `x" 1\`); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Set("NAME", "x\nHANGUP"); !errors.Is(err, ErrInvalidArgument) {
+		t.Errorf("got %v, want ErrInvalidArgument", err)
+	}
+}
+
+func TestMRCPPromptQuoting(t *testing.T) {
+	a, f := newFakeSession(t, "agi_version", "16.2.0")
+
+	go func() {
+		f.expect(`EXEC MRCPSynth "\"Say \\\"hi\\\", please\",p=default"`)
+		f.reply("200 result=0")
+		f.expect("GET VARIABLE SYNTHSTATUS")
+		f.reply("200 result=1 (OK)")
+		f.expect("GET VARIABLE SYNTH_COMPLETION_CAUSE")
+		f.reply("200 result=1 (0)")
+
+		f.expect(`EXEC MRCPRecog "\"<grammar>a, b</grammar>\",t=5000"`)
+		f.reply("200 result=0")
+		f.expect("GET VARIABLE RECOGSTATUS")
+		f.reply("200 result=1 (OK)")
+		f.expect("GET VARIABLE RECOG_COMPLETION_CAUSE")
+		f.reply("200 result=1 (0)")
+		f.expect("GET VARIABLE RECOG_RESULT")
+		f.reply("200 result=1 (x)")
+
+		f.expect(`EXEC SynthAndRecog "\"a, b\",\"builtin:grammar/digits\",t=5000"`)
+		f.conn.Close() // nolint: errcheck
+	}()
+
+	if _, err := a.MRCPSynth(`Say "hi", please`, "p=default"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.MRCPRecog("<grammar>a, b</grammar>", "t=5000"); err != nil {
+		t.Fatal(err)
+	}
+	a.SynthAndRecog("a, b", "builtin:grammar/digits", "t=5000") // nolint: errcheck
+}
@@ -0,0 +1,134 @@
+package agi
+
+import (
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrInvalidCommand indicates that Asterisk did not recognise the
+	// command (status 510).
+	ErrInvalidCommand = errors.New("invalid or unknown command")
+
+	// ErrDeadChannel indicates that the command cannot be performed because
+	// the channel has hung up (status 511).
+	ErrDeadChannel = errors.New("command not permitted on a dead channel")
+
+	// ErrUsage indicates that Asterisk did not accept the syntax of the
+	// command (status 520).  The CommandError will wrap a *UsageError
+	// carrying the proper usage.
+	ErrUsage = errors.New("invalid command syntax")
+
+	// ErrStatus indicates that Asterisk replied with a status code which is
+	// not otherwise classified.
+	ErrStatus = errors.New("unexpected status code")
+
+	// ErrUnsupported indicates that the connected version of Asterisk does
+	// not support the command, or one of its arguments.  The command is
+	// not sent.
+	ErrUnsupported = errors.New("command not supported by this version of Asterisk")
+
+	// ErrInvalidArgument indicates that a command argument contains
+	// characters which cannot be encoded for AGI.  The command is not sent.
+	ErrInvalidArgument = errors.New("invalid argument")
+
+	// ErrParse indicates that the reply from Asterisk could not be parsed.
+	ErrParse = errors.New("failed to parse response")
+
+	// ErrTransport indicates that the command could not be sent or its
+	// reply could not be received.  Once this occurs, the session is no
+	// longer usable.
+	ErrTransport = errors.New("transport failure")
+
+	// ErrCanceled indicates that the command's context was done before the
+	// command was sent or before its reply arrived.  The CommandError wraps
+	// the context's error.
+	ErrCanceled = errors.New("command canceled")
+
+	// ErrHangup indicates the channel hung up during processing.  It is also
+	// the cause of the session context's cancellation when Asterisk signals a
+	// hangup.
+	ErrHangup = errors.New("hangup")
+
+	// ErrIdleTimeout is the cause of the session context's cancellation
+	// when a Server closes a session which has sent no command for its
+	// IdleTimeout.
+	ErrIdleTimeout = errors.New("session idle timeout")
+
+	// ErrSessionTimeout is the cause of the session context's cancellation
+	// when a Server closes a session which has run for its
+	// MaxSessionDuration.
+	ErrSessionTimeout = errors.New("session duration exceeded")
+
+	// ErrSessionClosed is the cause of the session context's cancellation
+	// when a Server closes a session at the request of CloseSession (or of
+	// its AdminHandler).
+	ErrSessionClosed = errors.New("session closed by server")
+)
+
+// CommandError describes the failure of an AGI command.  It matches its Kind
+// under errors.Is, so callers may test for the sentinel errors above.
+type CommandError struct {
+	// Kind is the class of the failure; one of the Err* sentinel errors
+	// of this package.
+	Kind error
+
+	// Status is the status code received from Asterisk, if any
+	Status int
+
+	// Raw is the raw reply line received from Asterisk, if any
+	Raw string
+
+	// Err is the underlying error, if any
+	Err error
+}
+
+func (e *CommandError) Error() string {
+	msg := e.Kind.Error()
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	if e.Raw != "" {
+		msg += " (" + e.Raw + ")"
+	}
+	return msg
+}
+
+// Is reports whether the target is the Kind of this error.
+func (e *CommandError) Is(target error) bool {
+	return target == e.Kind
+}
+
+// Unwrap returns the underlying error, if any.
+func (e *CommandError) Unwrap() error {
+	return e.Err
+}
+
+// UsageError is returned (wrapped in a *CommandError) when Asterisk rejects
+// the syntax of a command.  It carries the usage text, if any, which Asterisk
+// sent in reply.
+type UsageError struct {
+	// Usage is the proper usage of the command, as
+	// described by Asterisk
+	Usage string
+}
+
+func (e *UsageError) Error() string {
+	if e.Usage == "" {
+		return "no usage available"
+	}
+	return e.Usage
+}
+
+// statusKind returns the sentinel error for the given non-200 status code.
+func statusKind(status int) error {
+	switch status {
+	case StatusInvalid:
+		return ErrInvalidCommand
+	case StatusDeadChannel:
+		return ErrDeadChannel
+	case StatusEndUsage:
+		return ErrUsage
+	default:
+		return ErrStatus
+	}
+}
@@ -0,0 +1,57 @@
+package agi
+
+import (
+	"context"
+	"time"
+)
+
+// Handler serves an AGI session.  The context is cancelled when the channel
+// hangs up or the session otherwise ends.  A returned error is logged by the
+// Server, and may be reported to Asterisk (see Server.StatusVariable).
+type Handler interface {
+	ServeAGI(ctx context.Context, a *AGI) error
+}
+
+// HandlerFunc is a function which accepts an AGI instance.  It implements
+// Handler, always returning a nil error.
+type HandlerFunc func(*AGI)
+
+// ServeAGI implements Handler
+func (f HandlerFunc) ServeAGI(ctx context.Context, a *AGI) error {
+	f(a)
+	return nil
+}
+
+// ServeFunc adapts an ordinary function to a Handler
+type ServeFunc func(ctx context.Context, a *AGI) error
+
+// ServeAGI implements Handler
+func (f ServeFunc) ServeAGI(ctx context.Context, a *AGI) error {
+	return f(ctx, a)
+}
+
+// Middleware wraps a Handler with additional behaviour, such as logging,
+// authentication, metrics, timeouts or recovery.
+type Middleware func(next Handler) Handler
+
+// Chain wraps the given handler in the given middleware.  The first
+// middleware is the outermost, and sees the session first.
+func Chain(h Handler, middleware ...Middleware) Handler {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		h = middleware[i](h)
+	}
+	return h
+}
+
+// Timeout returns a Middleware which cancels the handler's context after the
+// given duration.
+func Timeout(d time.Duration) Middleware {
+	return func(next Handler) Handler {
+		return ServeFunc(func(ctx context.Context, a *AGI) error {
+			ctx, cancel := context.WithTimeout(ctx, d)
+			defer cancel()
+
+			return next.ServeAGI(ctx, a)
+		})
+	}
+}
@@ -0,0 +1,63 @@
+package agi
+
+import (
+	"context"
+	"time"
+)
+
+// Invoker sends a command line to Asterisk and returns its response.  The
+// returned Response is never nil.
+type Invoker func(ctx context.Context, cmd string) *Response
+
+// Interceptor wraps the execution of each command on a session.  It is given
+// the command line and the next Invoker in the chain.  It may inspect or alter
+// the command line before calling next, inspect or alter the Response
+// afterwards, time the call, call next more than once (to retry) or not at all
+// (to fail or answer the command itself).  It must return a non-nil Response.
+type Interceptor func(ctx context.Context, cmd string, next Invoker) *Response
+
+// Use adds the given interceptors to the session.  Interceptors wrap every
+// subsequent command, in the order added: the first interceptor added is the
+// outermost, and sees the command first and the response last.
+func (a *AGI) Use(interceptors ...Interceptor) {
+	a.imu.Lock()
+	defer a.imu.Unlock()
+
+	// Copy, so that commands already in flight keep the chain they started with
+	a.interceptors = append(append([]Interceptor(nil), a.interceptors...), interceptors...)
+}
+
+// observer is told of a command, its response and its duration once it
+// completes
+type observer func(ctx context.Context, cmd string, resp *Response, dur time.Duration)
+
+// observe adds the given observer to the session.  Unlike interceptors,
+// observers see batched commands too.
+func (a *AGI) observe(f observer) {
+	a.imu.Lock()
+	defer a.imu.Unlock()
+
+	a.observers = append(append([]observer(nil), a.observers...), f)
+}
+
+// WithInterceptors returns a HandlerFunc which adds the given interceptors to
+// each session before passing it to the given handler.  It may be used to
+// apply the same interceptors to every session of a FastAGI service.
+func WithInterceptors(handler HandlerFunc, interceptors ...Interceptor) HandlerFunc {
+	return func(a *AGI) {
+		a.Use(interceptors...)
+		handler(a)
+	}
+}
+
+// chainInterceptors builds an Invoker which passes through each of the given
+// interceptors, in order, before reaching final.
+func chainInterceptors(interceptors []Interceptor, final Invoker) Invoker {
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], final
+		final = func(ctx context.Context, cmd string) *Response {
+			return interceptor(ctx, cmd, next)
+		}
+	}
+	return final
+}
@@ -0,0 +1,140 @@
+package agi
+
+import (
+	"log/slog"
+	"time"
+)
+
+// OverloadPolicy determines what a Server does with a session which arrives
+// when MaxSessions sessions are already active
+type OverloadPolicy int
+
+const (
+	// OverloadRefuse refuses the session at once, logging a message to the
+	// Asterisk console, hanging up the channel and closing the connection.
+	OverloadRefuse OverloadPolicy = iota
+
+	// OverloadQueue holds the session until another session finishes, for
+	// at most QueueTimeout, after which it is refused.  Queued sessions are
+	// also refused when the server shuts down.
+	OverloadQueue
+
+	// OverloadHandle passes the session to the OverloadHandler, if any,
+	// instead of the usual handler.  Without an OverloadHandler, the
+	// session is refused.
+	OverloadHandle
+)
+
+// OverloadMessage is the message sent to the Asterisk console when a Server
+// refuses a session because it is overloaded
+const OverloadMessage = "FastAGI server overloaded; call refused"
+
+// QueuedSessions returns the number of sessions waiting for a slot under the
+// OverloadQueue policy
+func (s *Server) QueuedSessions() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.queued
+}
+
+// acquire claims a session slot for the given session, waiting according to
+// the overload policy.  It returns false if no slot could be claimed.
+func (s *Server) acquire(a *AGI) bool {
+	if s.MaxSessions <= 0 {
+		s.addActive(1)
+		return true
+	}
+
+	sem := s.semaphore()
+	select {
+	case sem <- struct{}{}:
+		s.addActive(1)
+		return true
+	default:
+	}
+	if s.Overload != OverloadQueue {
+		return false
+	}
+
+	s.mu.Lock()
+	s.queued++
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.queued--
+		s.mu.Unlock()
+	}()
+
+	var timeout <-chan time.Time
+	if s.QueueTimeout > 0 {
+		t := time.NewTimer(s.QueueTimeout)
+		defer t.Stop()
+		timeout = t.C
+	}
+
+	select {
+	case sem <- struct{}{}:
+	case <-timeout:
+		return false
+	case <-a.Done():
+		return false
+	case <-s.doneChan():
+		return false
+	}
+	if s.shuttingDown() {
+		// A queued session must not start once shutdown has begun
+		<-sem
+		return false
+	}
+	s.addActive(1)
+	return true
+}
+
+// release frees the slot claimed by acquire
+func (s *Server) release() {
+	s.addActive(-1)
+	if s.MaxSessions > 0 {
+		<-s.semaphore()
+	}
+}
+
+// overloaded handles a session for which no slot could be claimed
+func (s *Server) overloaded(a *AGI) {
+	select {
+	case <-a.Done():
+		return
+	default:
+	}
+
+	reason := "server overloaded"
+	if s.shuttingDown() {
+		reason = "server shutting down"
+	}
+	s.logger().Warn("AGI session refused; "+reason, append(s.sessionAttrs(a), slog.Int("active", s.ActiveSessions()))...)
+	s.connEvent(a.conn, ConnOverloaded)
+
+	if s.Overload == OverloadHandle && s.OverloadHandler != nil {
+		s.finish(a, s.handle(a, s.OverloadHandler))
+		return
+	}
+
+	a.Verbose(OverloadMessage, 1) // nolint: errcheck
+	a.Hangup()                    // nolint: errcheck
+}
+
+func (s *Server) addActive(n int) {
+	s.mu.Lock()
+	s.active += n
+	s.mu.Unlock()
+}
+
+func (s *Server) semaphore() chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.sem == nil {
+		s.sem = make(chan struct{}, s.MaxSessions)
+	}
+	return s.sem
+}
@@ -0,0 +1,149 @@
+package agi
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// overloadServer starts srv with a handler which holds the session from
+// SIP/busy until release is closed, and otherwise sends "VERBOSE hello 1".
+// It returns the address and a connection holding the only session slot.
+func overloadServer(t *testing.T, srv *Server, release <-chan struct{}) (string, *asteriskConn) {
+	t.Helper()
+
+	srv.MaxSessions = 1
+	srv.Handler = HandlerFunc(func(a *AGI) {
+		if a.Variables["agi_channel"] == "SIP/busy" {
+			<-release
+			return
+		}
+		verboseHandler(a)
+	})
+	addr := startServer(t, srv)
+
+	busy := dialServer(t, addr, "agi_channel", "SIP/busy")
+	waitFor(t, "active session", func() bool { return srv.ActiveSessions() == 1 })
+	return addr, busy
+}
+
+// refused checks that the server refuses the session on c as overloaded
+func (c *asteriskConn) refused() {
+	c.t.Helper()
+
+	if got := c.next("200 result=1"); got != `VERBOSE "`+OverloadMessage+`" 1` {
+		c.t.Errorf("got %q, want the overload message", got)
+	}
+	if got := c.next("200 result=1"); got != "HANGUP" {
+		c.t.Errorf("got %q, want HANGUP", got)
+	}
+	if !c.closed() {
+		c.t.Error("refused connection not closed")
+	}
+}
+
+func TestOverloadRefuse(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+
+	addr, _ := overloadServer(t, &Server{}, release)
+	dialServer(t, addr).refused()
+}
+
+func TestOverloadQueue(t *testing.T) {
+	release := make(chan struct{})
+	srv := &Server{Overload: OverloadQueue}
+	addr, busy := overloadServer(t, srv, release)
+
+	queued := dialServer(t, addr)
+	waitFor(t, "queued session", func() bool { return srv.QueuedSessions() == 1 })
+	if n := srv.ActiveSessions(); n != 1 {
+		t.Errorf("%d active sessions with one queued", n)
+	}
+
+	close(release)
+	if !busy.closed() {
+		t.Error("session not closed")
+	}
+	if got := queued.next("200 result=1"); got != "VERBOSE hello 1" {
+		t.Errorf("queued session got %q", got)
+	}
+	if n := srv.QueuedSessions(); n != 0 {
+		t.Errorf("%d sessions queued after release", n)
+	}
+}
+
+func TestOverloadQueueTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+
+	srv := &Server{Overload: OverloadQueue, QueueTimeout: 50 * time.Millisecond}
+	addr, _ := overloadServer(t, srv, release)
+
+	queued := dialServer(t, addr)
+	waitFor(t, "queued session", func() bool { return srv.QueuedSessions() == 1 })
+	queued.refused()
+	if n := srv.QueuedSessions(); n != 0 {
+		t.Errorf("%d sessions queued after timeout", n)
+	}
+}
+
+func TestOverloadQueueShutdown(t *testing.T) {
+	release := make(chan struct{})
+	srv := &Server{Overload: OverloadQueue}
+	addr, busy := overloadServer(t, srv, release)
+
+	queued := dialServer(t, addr)
+	waitFor(t, "queued session", func() bool { return srv.QueuedSessions() == 1 })
+
+	done := make(chan error, 1)
+	go func() {
+		done <- srv.Shutdown(context.Background())
+	}()
+
+	// The queued session is refused at once, rather than waiting for a slot
+	// which would let it start after shutdown has begun
+	queued.refused()
+
+	close(release)
+	if !busy.closed() {
+		t.Error("session not closed")
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Shutdown: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Shutdown did not return")
+	}
+}
+
+func TestOverloadHandle(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+
+	srv := &Server{
+		Overload: OverloadHandle,
+		OverloadHandler: HandlerFunc(func(a *AGI) {
+			a.Verbose("busy", 1) // nolint: errcheck
+		}),
+		StatusVariable: "AGI_RESULT",
+	}
+	addr, _ := overloadServer(t, srv, release)
+
+	c := dialServer(t, addr)
+	if got := c.next("200 result=1"); got != "VERBOSE busy 1" {
+		t.Errorf("got %q from the overload handler", got)
+	}
+	if got := c.next("200 result=1"); got != "SET VARIABLE AGI_RESULT SUCCESS" {
+		t.Errorf("got %q", got)
+	}
+	if !c.closed() {
+		t.Error("overloaded session not closed")
+	}
+
+	// Without an OverloadHandler, the session is refused
+	addr, _ = overloadServer(t, &Server{Overload: OverloadHandle}, release)
+	dialServer(t, addr).refused()
+}
@@ -0,0 +1,290 @@
+package agi
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultLatencyBuckets are the upper bounds, in seconds, of the command
+// latency histogram buckets used when Metrics.Buckets is not set.  They reach
+// further than is usual for request latencies, since commands such as STREAM
+// FILE and GET DATA last as long as the prompts they play.
+var DefaultLatencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 120}
+
+// Metrics collects session and command metrics and serves them in the
+// Prometheus text exposition format.  It implements http.Handler, so it may be
+// mounted directly on a metrics endpoint.  The zero value is ready to use.
+//
+// The following metrics are exposed:
+//
+//	agi_connections_accepted_total               counter
+//	agi_connections_open                         gauge
+//	agi_connections_rejected_total{reason}       counter
+//	agi_sessions_accepted_total                  counter
+//	agi_sessions_active                          gauge
+//	agi_sessions_finished_total                  counter
+//	agi_hangups_total                            counter
+//	agi_command_duration_seconds{command}        histogram
+//	agi_command_responses_total{command,status}  counter
+//
+// The connection metrics are recorded when ConnHook is set as a Server's
+// ConnHook; they include connections rejected before any handler runs, such
+// as those refused under overload.  The session metrics are recorded by
+// Middleware (or Handler), and the command and hangup metrics by Instrument.
+type Metrics struct {
+	// Buckets are the upper bounds, in seconds, of the command latency
+	// histogram buckets.  They must be sorted and must not be changed once
+	// metrics have been recorded.  Defaults to DefaultLatencyBuckets.
+	Buckets []float64
+
+	mu sync.Mutex
+
+	connsAccepted uint64
+	connsOpen     int64
+
+	// rejected counts rejected connections by reason
+	rejected map[ConnEvent]uint64
+
+	sessionsAccepted uint64
+	sessionsActive   int64
+	sessionsFinished uint64
+	hangups          uint64
+
+	// latency is the latency histogram for each command
+	latency map[string]*histogram
+
+	// responses counts the responses to each command by status
+	responses map[responseKey]uint64
+}
+
+type responseKey struct {
+	command string
+	status  string
+}
+
+type histogram struct {
+	counts []uint64 // one per bucket, non-cumulative
+	sum    float64
+	count  uint64
+}
+
+// Handler returns a HandlerFunc which records the given handler's sessions as
+// accepted, active and finished, and instruments each session (see
+// Instrument).  It may be used with Listen:
+//
+//	agi.Listen(":4573", m.Handler(handler))
+func (m *Metrics) Handler(handler HandlerFunc) HandlerFunc {
+	h := m.Middleware(handler)
+	return func(a *AGI) {
+		h.ServeAGI(a.Context(), a) // nolint: errcheck
+	}
+}
+
+// Middleware is a Middleware which records sessions as accepted, active and
+// finished, and instruments each session (see Instrument).  It may be used
+// with a Server:
+//
+//	srv.Middleware = append(srv.Middleware, m.Middleware)
+func (m *Metrics) Middleware(next Handler) Handler {
+	return ServeFunc(func(ctx context.Context, a *AGI) error {
+		m.mu.Lock()
+		m.sessionsAccepted++
+		m.sessionsActive++
+		m.mu.Unlock()
+
+		defer func() {
+			m.mu.Lock()
+			m.sessionsActive--
+			m.sessionsFinished++
+			m.mu.Unlock()
+		}()
+
+		m.Instrument(a)
+		return next.ServeAGI(ctx, a)
+	})
+}
+
+// ConnHook records the connection events of a Server.  It may be set as the
+// server's ConnHook:
+//
+//	srv.ConnHook = m.ConnHook
+func (m *Metrics) ConnHook(conn net.Conn, event ConnEvent) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	switch event {
+	case ConnAccepted:
+		m.connsAccepted++
+		m.connsOpen++
+	case ConnClosed:
+		m.connsOpen--
+	default:
+		if m.rejected == nil {
+			m.rejected = make(map[ConnEvent]uint64)
+		}
+		m.rejected[event]++
+	}
+}
+
+// Instrument records the latency and response status of every command on the
+// given session, including batched commands, as well as any hangup signalled
+// by Asterisk.
+func (m *Metrics) Instrument(a *AGI) {
+	a.observe(func(ctx context.Context, cmd string, resp *Response, dur time.Duration) {
+		m.observe(commandVerb(cmd), resp, dur)
+	})
+
+	a.OnHangup(func() {
+		if context.Cause(a.Context()) == ErrHangup {
+			m.mu.Lock()
+			m.hangups++
+			m.mu.Unlock()
+		}
+	})
+}
+
+// observe records a single command
+func (m *Metrics) observe(verb string, resp *Response, dur time.Duration) {
+	status := "none"
+	if resp.Status != 0 {
+		status = strconv.Itoa(resp.Status)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.latency == nil {
+		m.latency = make(map[string]*histogram)
+		m.responses = make(map[responseKey]uint64)
+	}
+
+	h, ok := m.latency[verb]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(m.buckets()))}
+		m.latency[verb] = h
+	}
+	secs := dur.Seconds()
+	if i := sort.SearchFloat64s(m.buckets(), secs); i < len(h.counts) {
+		h.counts[i]++
+	}
+	h.sum += secs
+	h.count++
+
+	m.responses[responseKey{command: verb, status: status}]++
+}
+
+func (m *Metrics) buckets() []float64 {
+	if m.Buckets == nil {
+		return DefaultLatencyBuckets
+	}
+	return m.Buckets
+}
+
+// ServeHTTP serves the metrics in the Prometheus text exposition format
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.WriteTo(w) // nolint: errcheck
+}
+
+// WriteTo writes the metrics to the given writer in the Prometheus text
+// exposition format.
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	cw := &countingWriter{w: w}
+	b := bufio.NewWriter(cw)
+
+	writeHeader(b, "agi_connections_accepted_total", "counter", "Total number of connections accepted.")
+	fmt.Fprintf(b, "agi_connections_accepted_total %d\n", m.connsAccepted)
+	writeHeader(b, "agi_connections_open", "gauge", "Number of connections currently open.")
+	fmt.Fprintf(b, "agi_connections_open %d\n", m.connsOpen)
+	writeHeader(b, "agi_connections_rejected_total", "counter", "Total number of connections rejected, by reason.")
+	for _, event := range []ConnEvent{ConnDenied, ConnHandshakeFailed, ConnUnauthorized, ConnOverloaded} {
+		fmt.Fprintf(b, "agi_connections_rejected_total{reason=\"%s\"} %d\n", event, m.rejected[event])
+	}
+
+	writeHeader(b, "agi_sessions_accepted_total", "counter", "Total number of AGI sessions accepted.")
+	fmt.Fprintf(b, "agi_sessions_accepted_total %d\n", m.sessionsAccepted)
+	writeHeader(b, "agi_sessions_active", "gauge", "Number of AGI sessions currently active.")
+	fmt.Fprintf(b, "agi_sessions_active %d\n", m.sessionsActive)
+	writeHeader(b, "agi_sessions_finished_total", "counter", "Total number of AGI sessions finished.")
+	fmt.Fprintf(b, "agi_sessions_finished_total %d\n", m.sessionsFinished)
+	writeHeader(b, "agi_hangups_total", "counter", "Total number of hangups signalled by Asterisk.")
+	fmt.Fprintf(b, "agi_hangups_total %d\n", m.hangups)
+
+	verbs := make([]string, 0, len(m.latency))
+	for verb := range m.latency {
+		verbs = append(verbs, verb)
+	}
+	sort.Strings(verbs)
+
+	writeHeader(b, "agi_command_duration_seconds", "histogram", "Latency of AGI commands.")
+	for _, verb := range verbs {
+		h := m.latency[verb]
+		label := `command="` + escapeLabel(verb) + `"`
+
+		var cumulative uint64
+		for i, le := range m.buckets() {
+			cumulative += h.counts[i]
+			fmt.Fprintf(b, "agi_command_duration_seconds_bucket{%s,le=\"%s\"} %d\n", label, formatFloat(le), cumulative)
+		}
+		fmt.Fprintf(b, "agi_command_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", label, h.count)
+		fmt.Fprintf(b, "agi_command_duration_seconds_sum{%s} %s\n", label, formatFloat(h.sum))
+		fmt.Fprintf(b, "agi_command_duration_seconds_count{%s} %d\n", label, h.count)
+	}
+
+	keys := make([]responseKey, 0, len(m.responses))
+	for k := range m.responses {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].command != keys[j].command {
+			return keys[i].command < keys[j].command
+		}
+		return keys[i].status < keys[j].status
+	})
+
+	writeHeader(b, "agi_command_responses_total", "counter", "Total number of AGI command responses, by status code.")
+	for _, k := range keys {
+		fmt.Fprintf(b, "agi_command_responses_total{command=\"%s\",status=\"%s\"} %d\n", escapeLabel(k.command), k.status, m.responses[k])
+	}
+
+	err := b.Flush()
+	return cw.n, err
+}
+
+func writeHeader(w io.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(v string) string {
+	return labelEscaper.Replace(v)
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// countingWriter counts the bytes written to the underlying writer
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
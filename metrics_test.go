@@ -0,0 +1,66 @@
+package agi
+
+import (
+	"bytes"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func TestMetricsConnections(t *testing.T) {
+	var m Metrics
+
+	release := make(chan struct{})
+	srv := &Server{
+		Handler: HandlerFunc(func(a *AGI) {
+			<-release
+		}),
+		MaxSessions: 1,
+		ConnHook:    m.ConnHook,
+	}
+	addr := startServer(t, srv)
+
+	busy := dialServer(t, addr)
+	waitFor(t, "active session", func() bool { return srv.ActiveSessions() == 1 })
+
+	// Refused for overload
+	refused := dialServer(t, addr)
+	for refused.next("200 result=1") != "" {
+	}
+
+	// Refused by the deny list of another server
+	denier := &Server{
+		Handler:  srv.Handler,
+		Deny:     []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")},
+		ConnHook: m.ConnHook,
+	}
+	denied := dialServer(t, startServer(t, denier))
+	if !denied.closed() {
+		t.Error("denied connection not closed")
+	}
+
+	close(release)
+	if !busy.closed() {
+		t.Error("session not closed")
+	}
+	waitFor(t, "connections to close", func() bool {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		return m.connsOpen == 0
+	})
+
+	var out bytes.Buffer
+	if _, err := m.WriteTo(&out); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"agi_connections_accepted_total 3\n",
+		"agi_connections_open 0\n",
+		`agi_connections_rejected_total{reason="overloaded"} 1` + "\n",
+		`agi_connections_rejected_total{reason="denied"} 1` + "\n",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("metrics missing %q:\n%s", want, out.String())
+		}
+	}
+}
@@ -1,9 +1,9 @@
 package agi
 
 import (
+	"context"
 	"fmt"
 	"strconv"
-	"strings"
 
 	"github.com/pkg/errors"
 )
@@ -51,7 +51,7 @@ type RecognitionInterpretation struct {
 }
 
 // getRecognitionResult retrieves the set of channel variables which comprises the recognition result of a speech recognition MRCP session.  The "combo" parameter indicates whether the process was the SynthAndRecog combo application, which stored the STATUS differently from the singular MRCPSynth.
-func (a *AGI) getRecognitionResult(combo bool) (res *RecognitionResult, err error) {
+func (a *AGI) getRecognitionResult(ctx context.Context, combo bool) (res *RecognitionResult, err error) {
 	var cause string
 	res = new(RecognitionResult)
 
@@ -60,16 +60,16 @@ func (a *AGI) getRecognitionResult(combo bool) (res *RecognitionResult, err erro
 		statusVar = "RECOG_STATUS"
 	}
 
-	if res.Status, err = a.Get(statusVar); err != nil {
+	if res.Status, err = a.GetContext(ctx, statusVar); err != nil {
 		return res, errors.Wrap(err, "failed to retrieve status")
 	}
-	if cause, err = a.Get("RECOG_COMPLETION_CAUSE"); err != nil {
+	if cause, err = a.GetContext(ctx, "RECOG_COMPLETION_CAUSE"); err != nil {
 		return res, errors.Wrap(err, "failed to retrieve cause")
 	}
 	if res.Cause, err = strconv.Atoi(cause); err != nil {
 		return res, errors.Wrapf(err, "failed to parse cause (%s) as an integer", cause)
 	}
-	if res.Result, err = a.Get("RECOG_RESULT"); err != nil {
+	if res.Result, err = a.GetContext(ctx, "RECOG_RESULT"); err != nil {
 		return res, errors.Wrap(err, "failed to retrieve result")
 	}
 
@@ -106,10 +106,15 @@ type SynthResult struct {
 
 // MRCPSynth synthesizes speech for a prompt via MRCP. (requires UniMRCP app and resource to be compiled and loaded in Asterisk).
 func (a *AGI) MRCPSynth(prompt string, opts string) (res *SynthResult, err error) {
+	return a.MRCPSynthContext(context.Background(), prompt, opts)
+}
+
+// MRCPSynthContext synthesizes speech for a prompt via MRCP, giving up if ctx is done first. (requires UniMRCP app and resource to be compiled and loaded in Asterisk).
+func (a *AGI) MRCPSynthContext(ctx context.Context, prompt string, opts string) (res *SynthResult, err error) {
 	var cause string
 	res = new(SynthResult)
 
-	ret, err := a.Exec([]string{"MRCPSynth", prompt, opts}...)
+	ret, err := a.ExecContext(ctx, "MRCPSynth", quote(prompt), opts)
 	if err != nil {
 		return
 	}
@@ -117,10 +122,10 @@ func (a *AGI) MRCPSynth(prompt string, opts string) (res *SynthResult, err error
 		return res, errors.New("MRCP applications not loaded")
 	}
 
-	if res.Status, err = a.Get("SYNTHSTATUS"); err != nil {
+	if res.Status, err = a.GetContext(ctx, "SYNTHSTATUS"); err != nil {
 		return res, errors.Wrap(err, "failed to retrieve status")
 	}
-	if cause, err = a.Get("SYNTH_COMPLETION_CAUSE"); err != nil {
+	if cause, err = a.GetContext(ctx, "SYNTH_COMPLETION_CAUSE"); err != nil {
 		return res, errors.Wrap(err, "failed to retrieve cause")
 	}
 	if res.Cause, err = strconv.Atoi(cause); err != nil {
@@ -132,8 +137,13 @@ func (a *AGI) MRCPSynth(prompt string, opts string) (res *SynthResult, err error
 
 // MRCPRecog listens for speech and optionally plays a prompt. (requires UniMRCP app and resource to be compiled and loaded in Asterisk).
 func (a *AGI) MRCPRecog(grammar string, opts string) (*RecognitionResult, error) {
+	return a.MRCPRecogContext(context.Background(), grammar, opts)
+}
+
+// MRCPRecogContext listens for speech and optionally plays a prompt, giving up if ctx is done first. (requires UniMRCP app and resource to be compiled and loaded in Asterisk).
+func (a *AGI) MRCPRecogContext(ctx context.Context, grammar string, opts string) (*RecognitionResult, error) {
 
-	ret, err := a.Exec([]string{"MRCPRecog", grammar, opts}...)
+	ret, err := a.ExecContext(ctx, "MRCPRecog", quote(grammar), opts)
 	if err != nil {
 		return nil, err
 	}
@@ -141,18 +151,18 @@ func (a *AGI) MRCPRecog(grammar string, opts string) (*RecognitionResult, error)
 		return nil, errors.New("MRCP applications not loaded")
 	}
 
-	return a.getRecognitionResult(false)
+	return a.getRecognitionResult(ctx, false)
 }
 
 // SynthAndRecog plays a synthesized prompt and waits for speech to be recognized (requires UniMRCP app and resource to be compiled and loaded in Asterisk).
 func (a *AGI) SynthAndRecog(prompt string, grammar string, opts string) (*RecognitionResult, error) {
+	return a.SynthAndRecogContext(context.Background(), prompt, grammar, opts)
+}
 
-	execOpts := []string{
-		fmt.Sprintf(`"%s"`, prompt),
-		grammar,
-		opts,
-	}
-	ret, err := a.Exec([]string{"SynthAndRecog", strings.Join(execOpts, ",")}...)
+// SynthAndRecogContext plays a synthesized prompt and waits for speech to be recognized, giving up if ctx is done first (requires UniMRCP app and resource to be compiled and loaded in Asterisk).
+func (a *AGI) SynthAndRecogContext(ctx context.Context, prompt string, grammar string, opts string) (*RecognitionResult, error) {
+
+	ret, err := a.ExecContext(ctx, "SynthAndRecog", quote(prompt), quote(grammar), opts)
 	if err != nil {
 		return nil, err
 	}
@@ -160,7 +170,7 @@ func (a *AGI) SynthAndRecog(prompt string, grammar string, opts string) (*Recogn
 		return nil, errors.New("MRCP applications not loaded")
 	}
 
-	return a.getRecognitionResult(true)
+	return a.getRecognitionResult(ctx, true)
 }
 
 // RecognitionInterpretation returns the speech interpretation from the last MRCP speech recognition process.  The index is based on the set of results ordered by decreasing confidence.  Thus index 0 is the best match.
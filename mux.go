@@ -0,0 +1,138 @@
+package agi
+
+import (
+	"context"
+	"strings"
+)
+
+// Mux routes FastAGI sessions to handlers by the path of the script
+// requested by Asterisk (see AGI.Script).  It is a Handler, so may be used as
+// the handler of a Server.
+//
+// Patterns are slash-separated paths, such as "/ivr/sales".  A segment of the
+// form "{name}" matches any single segment of the script path, whose value is
+// then available from AGI.Param.  Where several patterns match, the one with
+// the most literal segments wins, and then the one registered first.
+type Mux struct {
+	// NotFound handles sessions whose script matches no pattern.  Defaults
+	// to NotFound.
+	NotFound Handler
+
+	routes []*route
+}
+
+type route struct {
+	segments []string
+	literals int
+
+	// Exactly one of handler and mux is set
+	handler Handler
+	mux     *Mux
+}
+
+// NewMux returns a new, empty Mux
+func NewMux() *Mux {
+	return new(Mux)
+}
+
+// Handle registers the handler for the given pattern
+func (m *Mux) Handle(pattern string, handler Handler) {
+	m.add(pattern, &route{handler: handler})
+}
+
+// HandleFunc registers the handler function for the given pattern
+func (m *Mux) HandleFunc(pattern string, handler func(*AGI)) {
+	m.Handle(pattern, HandlerFunc(handler))
+}
+
+// Mount registers a sub-router for the given pattern prefix.  Sessions whose
+// script path begins with the prefix are routed by the sub-router on the
+// remainder of the path.  Parameters matched by the prefix remain available.
+func (m *Mux) Mount(prefix string, sub *Mux) {
+	m.add(prefix, &route{mux: sub})
+}
+
+func (m *Mux) add(pattern string, r *route) {
+	r.segments = splitPath(pattern)
+	for _, seg := range r.segments {
+		if !isParam(seg) {
+			r.literals++
+		}
+	}
+
+	// Keep the routes ordered by specificity, then registration order
+	i := len(m.routes)
+	for i > 0 && m.routes[i-1].literals < r.literals {
+		i--
+	}
+	m.routes = append(m.routes, nil)
+	copy(m.routes[i+1:], m.routes[i:])
+	m.routes[i] = r
+}
+
+// ServeAGI routes the given session to the matching handler
+func (m *Mux) ServeAGI(ctx context.Context, a *AGI) error {
+	return m.serve(ctx, a, splitPath(a.Script()))
+}
+
+func (m *Mux) serve(ctx context.Context, a *AGI, path []string) error {
+	for _, r := range m.routes {
+		params, rest, ok := r.match(path)
+		if !ok {
+			continue
+		}
+		for k, v := range params {
+			a.setParam(k, v)
+		}
+		if r.mux != nil {
+			return r.mux.serve(ctx, a, rest)
+		}
+		return r.handler.ServeAGI(ctx, a)
+	}
+
+	if m.NotFound != nil {
+		return m.NotFound.ServeAGI(ctx, a)
+	}
+	return HandlerFunc(NotFound).ServeAGI(ctx, a)
+}
+
+// match matches the route against the given path.  Handler routes must match
+// the whole path; sub-router routes match a prefix of it, and return the
+// rest.
+func (r *route) match(path []string) (params map[string]string, rest []string, ok bool) {
+	if len(path) < len(r.segments) || (r.mux == nil && len(path) != len(r.segments)) {
+		return nil, nil, false
+	}
+	for i, seg := range r.segments {
+		if isParam(seg) {
+			if params == nil {
+				params = make(map[string]string)
+			}
+			params[seg[1:len(seg)-1]] = path[i]
+			continue
+		}
+		if seg != path[i] {
+			return nil, nil, false
+		}
+	}
+	return params, path[len(r.segments):], true
+}
+
+// NotFound is the default handler for sessions whose script matches no
+// route.  It logs the fact to the Asterisk console, then hangs up.
+func NotFound(a *AGI) {
+	a.Verbose("no AGI handler for script "+a.Script(), 1) // nolint: errcheck
+	a.Hangup()                                            // nolint: errcheck
+}
+
+func splitPath(p string) []string {
+	p = strings.Trim(p, "/")
+	if p == "" {
+		return nil
+	}
+	return strings.Split(p, "/")
+}
+
+func isParam(seg string) bool {
+	return len(seg) > 2 && seg[0] == '{' && seg[len(seg)-1] == '}'
+}
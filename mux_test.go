@@ -0,0 +1,100 @@
+package agi
+
+import (
+	"context"
+	"testing"
+)
+
+// serveScript runs the given mux on a session requesting the given script,
+// returning the session
+func serveScript(t *testing.T, m *Mux, script string) *AGI {
+	t.Helper()
+
+	a, _ := newFakeSession(t, "agi_network_script", script)
+	if err := m.ServeAGI(context.Background(), a); err != nil {
+		t.Fatalf("ServeAGI(%q): %v", script, err)
+	}
+	return a
+}
+
+func TestMux(t *testing.T) {
+	var served string
+	handler := func(name string) func(*AGI) {
+		return func(a *AGI) { served = name }
+	}
+
+	m := NewMux()
+	m.NotFound = HandlerFunc(handler("notfound"))
+	m.HandleFunc("/ivr/{dept}", handler("dept"))
+	m.HandleFunc("/ivr/sales", handler("sales"))
+	m.HandleFunc("/ivr/{dept}/{ext}", handler("ext"))
+	m.HandleFunc("/{any}/sales", handler("any-sales"))
+	m.HandleFunc("/", handler("root"))
+
+	sub := NewMux()
+	sub.NotFound = HandlerFunc(handler("tenant-notfound"))
+	sub.HandleFunc("/queue/{name}", handler("queue"))
+	sub.HandleFunc("/", handler("tenant-root"))
+	m.Mount("/tenant/{tenant}", sub)
+
+	tests := []struct {
+		script string
+		want   string
+		params map[string]string
+	}{
+		// Literal routes win over parameters, whatever the order
+		{"ivr/sales", "sales", nil},
+		{"ivr/support", "dept", map[string]string{"dept": "support"}},
+		{"ivr/support/100", "ext", map[string]string{"dept": "support", "ext": "100"}},
+		// With equal literals, the first registered wins
+		{"main/sales", "any-sales", map[string]string{"any": "main"}},
+		{"", "root", nil},
+		{"tenant/acme/queue/billing", "queue", map[string]string{"tenant": "acme", "name": "billing"}},
+		{"tenant/acme", "tenant-root", map[string]string{"tenant": "acme"}},
+		// A sub-router handles what it cannot route itself
+		{"tenant/acme/nowhere", "tenant-notfound", nil},
+		{"ivr", "notfound", nil},
+		{"ivr/sales/100/extra", "notfound", nil},
+	}
+	for _, tt := range tests {
+		served = ""
+		a := serveScript(t, m, tt.script)
+		if served != tt.want {
+			t.Errorf("%q served by %q, want %q", tt.script, served, tt.want)
+		}
+		for k, v := range tt.params {
+			if p := a.Param(k); p != v {
+				t.Errorf("%q: Param(%q) = %q, want %q", tt.script, k, p, v)
+			}
+		}
+	}
+}
+
+func TestMuxQuery(t *testing.T) {
+	m := NewMux()
+	var lang, dept string
+	m.HandleFunc("/ivr/{dept}", func(a *AGI) {
+		lang = a.Query().Get("lang")
+		dept = a.Param("dept")
+	})
+
+	serveScript(t, m, "ivr/sales?lang=fr")
+	if dept != "sales" || lang != "fr" {
+		t.Errorf("dept = %q, lang = %q", dept, lang)
+	}
+}
+
+func TestMuxDefaultNotFound(t *testing.T) {
+	a, f := newFakeSession(t, "agi_network_script", "nowhere")
+
+	go func() {
+		f.expect(`VERBOSE "no AGI handler for script /nowhere" 1`)
+		f.reply("200 result=1")
+		f.expect("HANGUP")
+		f.reply("200 result=1")
+	}()
+
+	if err := NewMux().ServeAGI(context.Background(), a); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,65 @@
+package agi
+
+import (
+	"fmt"
+	"log/slog"
+	"runtime/debug"
+)
+
+// PanicError is the error recorded when a handler run by a Server panics
+type PanicError struct {
+	// Value is the value passed to panic
+	Value interface{}
+
+	// Stack is the stack trace of the panicking goroutine
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("handler panic: %v", e.Value)
+}
+
+// handle runs the given handler for the given session, converting a panic
+// into a *PanicError.
+func (s *Server) handle(a *AGI, h Handler) (err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			err = &PanicError{Value: v, Stack: debug.Stack()}
+		}
+	}()
+
+	return h.ServeAGI(a.Context(), a)
+}
+
+// recovered logs a handler panic and runs the panic fallback, if any
+func (s *Server) recovered(a *AGI, perr *PanicError) {
+	s.logger().Error("AGI handler panicked", append(s.sessionAttrs(a), slog.Any("panic", perr.Value), slog.String("stack", string(perr.Stack)))...)
+
+	if s.PanicFallback == nil {
+		return
+	}
+
+	defer func() {
+		if v := recover(); v != nil {
+			s.logger().Error("AGI panic fallback panicked", append(s.sessionAttrs(a), slog.Any("panic", v))...)
+		}
+	}()
+	s.PanicFallback(a)
+}
+
+// RedirectFallback returns a PanicFallback which sends the channel to the
+// given dialplan location when the AGI script ends, such as an error
+// context which apologises to the caller.
+func RedirectFallback(context, extension, priority string) HandlerFunc {
+	return func(a *AGI) {
+		for _, cmd := range [][]string{
+			{"SET CONTEXT", context},
+			{"SET EXTENSION", extension},
+			{"SET PRIORITY", priority},
+		} {
+			if err := a.command(a.Context(), cmd[0], cmd[1]).Err(); err != nil {
+				return
+			}
+		}
+	}
+}
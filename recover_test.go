@@ -0,0 +1,118 @@
+package agi
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// logRecorder collects the records of a JSON slog handler
+type logRecorder struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (r *logRecorder) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.buf.Write(p)
+}
+
+func (r *logRecorder) logger() *slog.Logger {
+	return slog.New(slog.NewJSONHandler(r, nil))
+}
+
+// find returns the first record with the given message, if any
+func (r *logRecorder) find(msg string) map[string]any {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, line := range strings.Split(r.buf.String(), "\n") {
+		var rec map[string]any
+		if json.Unmarshal([]byte(line), &rec) == nil && rec["msg"] == msg {
+			return rec
+		}
+	}
+	return nil
+}
+
+func TestHandlerPanic(t *testing.T) {
+	var logs logRecorder
+	srv := &Server{
+		Handler: HandlerFunc(func(a *AGI) {
+			if a.Variables["agi_channel"] == "SIP/panic" {
+				panic("boom")
+			}
+			verboseHandler(a)
+		}),
+		PanicFallback: func(a *AGI) {
+			a.Verbose("sorry", 1) // nolint: errcheck
+			panic("fallback boom")
+		},
+		StatusVariable: "AGI_RESULT",
+		Logger:         logs.logger(),
+	}
+	addr := startServer(t, srv)
+
+	c := dialServer(t, addr, "agi_channel", "SIP/panic", "agi_uniqueid", "1700000000.7")
+	if got := c.next("200 result=1"); got != "VERBOSE sorry 1" {
+		t.Errorf("fallback sent %q", got)
+	}
+	if got := c.next("200 result=1"); got != "SET VARIABLE AGI_RESULT FAILURE" {
+		t.Errorf("got %q", got)
+	}
+	if !c.closed() {
+		t.Error("connection not closed after panic")
+	}
+
+	rec := logs.find("AGI handler panicked")
+	if rec == nil {
+		t.Fatal("panic not logged")
+	}
+	if rec["panic"] != "boom" || rec["agi_channel"] != "SIP/panic" || rec["agi_uniqueid"] != "1700000000.7" {
+		t.Errorf("panic record = %v", rec)
+	}
+	if stack, _ := rec["stack"].(string); !strings.Contains(stack, "TestHandlerPanic") {
+		t.Errorf("stack does not show the panicking handler:\n%s", stack)
+	}
+	if rec := logs.find("AGI panic fallback panicked"); rec == nil || rec["panic"] != "fallback boom" || rec["agi_channel"] != "SIP/panic" {
+		t.Errorf("fallback panic record = %v", rec)
+	}
+
+	// The server carries on serving
+	c = dialServer(t, addr, "agi_channel", "SIP/fine")
+	if got := c.next("200 result=1"); got != "VERBOSE hello 1" {
+		t.Errorf("after panic, got %q", got)
+	}
+	if got := c.next("200 result=1"); got != "SET VARIABLE AGI_RESULT SUCCESS" {
+		t.Errorf("after panic, got %q", got)
+	}
+}
+
+func TestHandlerPanicStatus(t *testing.T) {
+	srv := &Server{
+		Handler: HandlerFunc(func(a *AGI) {
+			panic("boom")
+		}),
+		PanicFallback:  RedirectFallback("errors", "s", "1"),
+		StatusVariable: "AGI_RESULT",
+	}
+	c := dialServer(t, startServer(t, srv))
+
+	for _, want := range []string{
+		"SET CONTEXT errors",
+		"SET EXTENSION s",
+		"SET PRIORITY 1",
+		"SET VARIABLE AGI_RESULT FAILURE",
+	} {
+		if got := c.next("200 result=0"); got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	}
+	if !c.closed() {
+		t.Error("connection not closed after panic")
+	}
+}
@@ -0,0 +1,146 @@
+package agi
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// SessionInfo describes an open session of a Server
+type SessionInfo struct {
+	// ID identifies the session within the server
+	ID uint64 `json:"id"`
+
+	// RemoteAddr is the address of the Asterisk end of the connection
+	RemoteAddr string `json:"remote_addr"`
+
+	// Channel is the name of the channel (agi_channel)
+	Channel string `json:"channel"`
+
+	// UniqueID is the unique ID of the channel (agi_uniqueid)
+	UniqueID string `json:"uniqueid"`
+
+	// Script is the path of the requested script (see AGI.Script)
+	Script string `json:"script"`
+
+	// Start is the time the session was accepted
+	Start time.Time `json:"start"`
+
+	// LastCommand is the verb of the last command sent, such as
+	// "STREAM FILE", if any.  Arguments are omitted, as they may be
+	// sensitive.
+	LastCommand string `json:"last_command,omitempty"`
+
+	// LastCommandTime is the time the last command was sent, if any
+	LastCommandTime *time.Time `json:"last_command_time,omitempty"`
+}
+
+// sessionEntry is the server's record of an open session
+type sessionEntry struct {
+	// info describes the session, but for its last command.  It is copied
+	// from the session as it is tracked, so that listing sessions does not
+	// race with handlers using its Variables.
+	info SessionInfo
+}
+
+// newSessionEntry records the given session, accepted at start
+func newSessionEntry(a *AGI, id uint64, start time.Time) *sessionEntry {
+	e := &sessionEntry{info: SessionInfo{
+		ID:       id,
+		Channel:  a.Variables["agi_channel"],
+		UniqueID: a.Variables["agi_uniqueid"],
+		Script:   a.Script(),
+		Start:    start,
+	}}
+	if a.conn != nil {
+		e.info.RemoteAddr = a.conn.RemoteAddr().String()
+	}
+	return e
+}
+
+// Sessions returns a description of each open session, oldest first
+func (s *Server) Sessions() []SessionInfo {
+	s.mu.Lock()
+	list := make([]SessionInfo, 0, len(s.sessions))
+	for a, e := range s.sessions {
+		list = append(list, a.sessionInfo(e))
+	}
+	s.mu.Unlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].ID < list[j].ID
+	})
+	return list
+}
+
+// CloseSession forcibly closes the open session with the given ID, reporting
+// whether there was one.  The session's context is cancelled with the cause
+// ErrSessionClosed.
+func (s *Server) CloseSession(id uint64) bool {
+	var target *AGI
+	s.mu.Lock()
+	for a, e := range s.sessions {
+		if e.info.ID == id {
+			target = a
+			break
+		}
+	}
+	s.mu.Unlock()
+
+	if target == nil {
+		return false
+	}
+	s.logger().Warn("AGI session closed", append(s.sessionAttrs(target), slog.String("error", ErrSessionClosed.Error()))...)
+
+	target.hangup(ErrSessionClosed)
+	target.Close() // nolint: errcheck
+	return true
+}
+
+// AdminHandler returns an http.Handler for inspecting the server's open
+// sessions.  A GET request lists them as a JSON array of SessionInfo.  A
+// DELETE request with an id query parameter forcibly closes that session.
+//
+// The handler offers no authentication of its own; take care to expose it
+// only to operators.
+func (s *Server) AdminHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead:
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(s.Sessions()) // nolint: errcheck
+		case http.MethodDelete:
+			id, err := strconv.ParseUint(r.URL.Query().Get("id"), 10, 64)
+			if err != nil {
+				http.Error(w, "invalid session id", http.StatusBadRequest)
+				return
+			}
+			if !s.CloseSession(id) {
+				http.Error(w, "no such session", http.StatusNotFound)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.Header().Set("Allow", "GET, HEAD, DELETE")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+// sessionInfo describes the session, as recorded by a server
+func (a *AGI) sessionInfo(e *sessionEntry) SessionInfo {
+	info := e.info
+
+	a.amu.Lock()
+	info.LastCommand = a.lastVerb
+	if !a.lastVerbTime.IsZero() {
+		t := a.lastVerbTime
+		info.LastCommandTime = &t
+	}
+	a.amu.Unlock()
+
+	return info
+}
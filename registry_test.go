@@ -0,0 +1,109 @@
+package agi
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// adminGet lists the sessions through the server's AdminHandler, returning
+// the raw JSON and the decoded list
+func adminGet(t *testing.T, srv *Server) (string, []SessionInfo) {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	srv.AdminHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET status = %d", rec.Code)
+	}
+
+	var list []SessionInfo
+	if err := json.Unmarshal(rec.Body.Bytes(), &list); err != nil {
+		t.Fatal(err)
+	}
+	return rec.Body.String(), list
+}
+
+func TestAdminHandler(t *testing.T) {
+	proceed := make(chan struct{})
+	srv := &Server{}
+	addr, causes := sessionCause(t, srv, func(a *AGI) {
+		<-proceed
+		a.Command("NOOP") // nolint: errcheck
+	})
+
+	c := dialServer(t, addr, "agi_channel", "PJSIP/100-00000001", "agi_uniqueid", "1700000000.1", "agi_network_script", "ivr")
+	waitFor(t, "session", func() bool { return len(srv.Sessions()) == 1 })
+
+	raw, list := adminGet(t, srv)
+	if strings.Contains(raw, "last_command") {
+		t.Errorf("last command reported before any was sent: %s", raw)
+	}
+	info := list[0]
+	if info.Channel != "PJSIP/100-00000001" || info.UniqueID != "1700000000.1" || info.Script != "/ivr" || info.RemoteAddr == "" {
+		t.Errorf("session = %+v", info)
+	}
+
+	close(proceed)
+	if got := c.next("200 result=0"); got != "NOOP" {
+		t.Fatalf("got %q", got)
+	}
+	waitFor(t, "last command", func() bool { return srv.Sessions()[0].LastCommandTime != nil })
+	if _, list = adminGet(t, srv); list[0].LastCommand != "NOOP" || list[0].LastCommandTime == nil {
+		t.Errorf("session after command = %+v", list[0])
+	}
+
+	for _, tt := range []struct {
+		method, target string
+		want           int
+	}{
+		{http.MethodDelete, "/?id=bogus", http.StatusBadRequest},
+		{http.MethodDelete, "/?id=999", http.StatusNotFound},
+		{http.MethodPost, "/", http.StatusMethodNotAllowed},
+	} {
+		rec := httptest.NewRecorder()
+		srv.AdminHandler().ServeHTTP(rec, httptest.NewRequest(tt.method, tt.target, nil))
+		if rec.Code != tt.want {
+			t.Errorf("%s %s status = %d, want %d", tt.method, tt.target, rec.Code, tt.want)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	srv.AdminHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/?id="+strconv.FormatUint(info.ID, 10), nil))
+	if rec.Code != http.StatusNoContent {
+		t.Errorf("DELETE status = %d", rec.Code)
+	}
+	waitCause(t, causes, ErrSessionClosed)
+	if !c.closed() {
+		t.Error("session not closed")
+	}
+}
+
+func TestSessionsConcurrentVariables(t *testing.T) {
+	// Listing sessions must not read Variables, which the session's own
+	// goroutine may be writing
+	stop := make(chan struct{})
+	srv := &Server{}
+	addr, _ := sessionCause(t, srv, func(a *AGI) {
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+				a.Variables["agi_arg_9"] = strconv.Itoa(i)
+			}
+		}
+	})
+
+	dialServer(t, addr, "agi_channel", "PJSIP/100-00000001")
+	waitFor(t, "session", func() bool { return len(srv.Sessions()) == 1 })
+	for i := 0; i < 100; i++ {
+		if got := srv.Sessions()[0].Channel; got != "PJSIP/100-00000001" {
+			t.Fatalf("channel = %q", got)
+		}
+	}
+	close(stop)
+}
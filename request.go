@@ -0,0 +1,63 @@
+package agi
+
+import (
+	"net/url"
+	"strings"
+)
+
+// Script returns the path of the script requested by Asterisk, without any
+// query string.  For FastAGI, this is the path of the agi:// URL, such as
+// "/ivr/sales" for "agi://host/ivr/sales?lang=en".  For AGI over stdio, it is
+// the name of the script.
+func (a *AGI) Script() string {
+	return a.script
+}
+
+// Query returns the query values of the script requested by Asterisk, such as
+// lang=en for "agi://host/ivr/sales?lang=en".
+func (a *AGI) Query() url.Values {
+	return a.query
+}
+
+// Param returns the value of the named path parameter, as matched by a Mux,
+// or the empty string if there is none.
+func (a *AGI) Param(name string) string {
+	a.parmu.Lock()
+	defer a.parmu.Unlock()
+
+	return a.params[name]
+}
+
+func (a *AGI) setParam(name, value string) {
+	a.parmu.Lock()
+	defer a.parmu.Unlock()
+
+	if a.params == nil {
+		a.params = make(map[string]string)
+	}
+	a.params[name] = value
+}
+
+// parseRequest extracts the script path and query from the given session
+// variables.
+func parseRequest(vars map[string]string) (script string, query url.Values) {
+	raw, ok := vars["agi_network_script"]
+	if !ok {
+		// agi_request is the full URL for FastAGI, but merely the script
+		// name for AGI over stdio
+		raw = vars["agi_request"]
+		if u, err := url.Parse(raw); err == nil && (u.Scheme == "agi" || u.Scheme == "hagi") {
+			raw = u.Path
+			if u.RawQuery != "" {
+				raw += "?" + u.RawQuery
+			}
+		}
+	}
+
+	script, rawQuery, _ := strings.Cut(raw, "?")
+	if !strings.HasPrefix(script, "/") && vars["agi_network"] == "yes" {
+		script = "/" + script
+	}
+	query, _ = url.ParseQuery(rawQuery) // nolint: errcheck
+	return script, query
+}
@@ -0,0 +1,483 @@
+package agi
+
+import (
+	"context"
+	"crypto/tls"
+	"log/slog"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrServerClosed is returned by Server.Serve and Server.ListenAndServe after
+// a call to Server.Shutdown or Server.Close.
+var ErrServerClosed = errors.New("agi: Server closed")
+
+// DefaultHeaderTimeout is the HeaderTimeout used when it is not set
+const DefaultHeaderTimeout = 10 * time.Second
+
+// Server is a FastAGI server.  The zero value, with a Handler, is ready to
+// use.
+type Server struct {
+	// Addr is the TCP address to listen on for ListenAndServe.  Defaults to
+	// "localhost:4573".
+	Addr string
+
+	// Handler is called, on its own goroutine, for each session.  The
+	// session is closed when it returns.
+	Handler Handler
+
+	// Middleware wraps Handler, the first middleware being the outermost.
+	Middleware []Middleware
+
+	// Interceptors are added to each session before it is handled (see
+	// AGI.Use).
+	Interceptors []Interceptor
+
+	// StatusVariable, if set, names a channel variable which is set to
+	// "SUCCESS" when the handler returns nil, or "FAILURE" when it returns
+	// an error, so that the dialplan may react, much as it does to
+	// AGISTATUS.
+	StatusVariable string
+
+	// PanicFallback, if set, is called when a handler panics, after the
+	// panic is logged and before the session is closed.  It may, for
+	// instance, set a variable or redirect the channel to an error
+	// context.  Handler panics are always recovered.
+	PanicFallback HandlerFunc
+
+	// MaxSessions limits the number of sessions handled at once.  Zero
+	// means no limit.  It must not be changed once the server has started.
+	MaxSessions int
+
+	// Overload determines what happens to sessions which arrive when
+	// MaxSessions sessions are active.  Defaults to OverloadRefuse.
+	Overload OverloadPolicy
+
+	// QueueTimeout is how long a session is queued, under the
+	// OverloadQueue policy, before it is refused.  Zero means until the
+	// caller hangs up or the server shuts down.
+	QueueTimeout time.Duration
+
+	// OverloadHandler handles sessions under the OverloadHandle policy.
+	// Middleware is not applied to it.
+	OverloadHandler Handler
+
+	// HeaderTimeout is the longest a connection may take to complete any
+	// TLS handshake and send its AGI request header, which Asterisk sends
+	// at once.  Connections which take longer are closed.  Defaults to
+	// DefaultHeaderTimeout.
+	HeaderTimeout time.Duration
+
+	// IdleTimeout, if set, is the longest a session may go without a
+	// command in flight.  A session which exceeds it is closed, and its
+	// context cancelled with the cause ErrIdleTimeout.  A command awaiting
+	// its reply is not idle, however long it waits, since commands such as
+	// EXEC of Dial may rightly last for hours; only MaxSessionDuration
+	// bounds a session whose Asterisk has stopped replying.
+	IdleTimeout time.Duration
+
+	// MaxSessionDuration, if set, is the longest a session may last,
+	// counted from the accept of its connection.  A session which exceeds
+	// it is closed, and its context cancelled with the cause
+	// ErrSessionTimeout.
+	MaxSessionDuration time.Duration
+
+	// Allow, if not empty, lists the networks from which connections are
+	// accepted.  Connections from other IP addresses are closed at once.
+	Allow []netip.Prefix
+
+	// Deny lists networks from which connections are refused, even if they
+	// are also in Allow.
+	Deny []netip.Prefix
+
+	// AuthToken, if set, is a shared secret which each session must
+	// present in its request, as the query parameter AuthTokenParam of the
+	// agi:// URL or as the AGI argument AuthTokenArg.  Sessions which do
+	// not are closed before the handler runs.  The token is removed from
+	// the session's variables before any handler sees them.
+	AuthToken string
+
+	// AuthTokenParam names the query parameter holding the token.
+	// Defaults to DefaultAuthTokenParam.
+	AuthTokenParam string
+
+	// AuthTokenArg, if set, is the number N of the agi_arg_N variable
+	// holding the token, which is then used instead of the query
+	// parameter.
+	AuthTokenArg int
+
+	// TLSConfig configures TLS for ServeTLS and ListenAndServeTLS
+	TLSConfig *tls.Config
+
+	// ConnHook, if set, is called as each connection is accepted,
+	// rejected and closed.  It is called synchronously, so must not block.
+	// Metrics.ConnHook may be used to record these events.
+	ConnHook func(conn net.Conn, event ConnEvent)
+
+	// Logger receives the server's own log records, such as accept
+	// errors and errors returned by handlers.  Defaults to slog.Default().
+	Logger *slog.Logger
+
+	mu         sync.Mutex
+	inShutdown bool
+	done       chan struct{} // closed on shutdown
+	listeners  map[*net.Listener]struct{}
+	conns      map[net.Conn]time.Time // accepted, but not yet sessions
+	sessions   map[*AGI]*sessionEntry
+	lastID     uint64
+	sem        chan struct{}
+	active     int
+	queued     int
+}
+
+// ListenAndServe listens on the TCP address s.Addr and then calls Serve.  It
+// always returns a non-nil error; after Shutdown or Close, ErrServerClosed.
+func (s *Server) ListenAndServe() error {
+	if s.shuttingDown() {
+		return ErrServerClosed
+	}
+
+	addr := s.Addr
+	if addr == "" {
+		addr = "localhost:4573"
+	}
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return errors.Wrap(err, "failed to bind server")
+	}
+	return s.Serve(l)
+}
+
+// Serve accepts FastAGI connections on the given listener, serving each on
+// its own goroutine.  Temporary accept errors are retried with backoff.
+// Serve always returns a non-nil error and closes l; after Shutdown or Close,
+// the error is ErrServerClosed.
+func (s *Server) Serve(l net.Listener) error {
+	if !s.trackListener(&l, true) {
+		l.Close() // nolint: errcheck
+		return ErrServerClosed
+	}
+	defer s.trackListener(&l, false)
+	defer l.Close() // nolint: errcheck
+
+	var delay time.Duration
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if s.shuttingDown() {
+				return ErrServerClosed
+			}
+			if isTemporary(err) {
+				if delay == 0 {
+					delay = 5 * time.Millisecond
+				} else if delay *= 2; delay > time.Second {
+					delay = time.Second
+				}
+				s.logger().Warn("temporary accept error; retrying", slog.String("error", err.Error()), slog.Duration("delay", delay))
+				time.Sleep(delay)
+				continue
+			}
+			return errors.Wrap(err, "failed to accept connection")
+		}
+		delay = 0
+		s.connEvent(conn, ConnAccepted)
+
+		if !s.permitted(conn.RemoteAddr()) {
+			s.reject(conn, ConnDenied)
+			continue
+		}
+		if !s.trackConn(conn, true) {
+			conn.Close() // nolint: errcheck
+			s.connEvent(conn, ConnClosed)
+			continue
+		}
+
+		go s.serveConn(conn)
+	}
+}
+
+// serveConn runs the handler for a single connection, which has been tracked
+// by trackConn
+func (s *Server) serveConn(conn net.Conn) {
+	defer s.connEvent(conn, ConnClosed)
+	defer s.trackConn(conn, false)
+
+	deadline := time.Now().Add(s.headerTimeout())
+	if !s.handshake(conn, deadline) {
+		return
+	}
+
+	conn.SetReadDeadline(deadline) // nolint: errcheck
+	a := NewConn(conn)
+	defer a.Close() // nolint: errcheck
+
+	if a.headerErr != nil {
+		s.logger().Warn("failed to read AGI request header", slog.String("remote_addr", conn.RemoteAddr().String()), slog.String("error", a.headerErr.Error()))
+		return
+	}
+	conn.SetReadDeadline(time.Time{}) // nolint: errcheck
+
+	if !s.trackSession(a, true) {
+		return
+	}
+	defer s.trackSession(a, false)
+	defer s.watchDeadlines(a)()
+
+	if !s.authenticate(a) {
+		s.logger().Warn("AGI session rejected", append(s.sessionAttrs(a), slog.String("reason", "invalid authentication token"))...)
+		s.connEvent(conn, ConnUnauthorized)
+		return
+	}
+
+	a.Use(s.Interceptors...)
+
+	if !s.acquire(a) {
+		s.overloaded(a)
+		return
+	}
+	defer s.release()
+
+	s.finish(a, s.handle(a, Chain(s.Handler, s.Middleware...)))
+}
+
+// finish logs and reports the outcome of a session's handler
+func (s *Server) finish(a *AGI, err error) {
+	if perr, ok := err.(*PanicError); ok {
+		s.recovered(a, perr)
+	} else if err != nil {
+		s.logger().Error("AGI handler failed", append(s.sessionAttrs(a), slog.String("error", err.Error()))...)
+	}
+
+	if s.StatusVariable != "" {
+		status := "SUCCESS"
+		if err != nil {
+			status = "FAILURE"
+		}
+		a.Set(s.StatusVariable, status) // nolint: errcheck
+	}
+}
+
+// Shutdown gracefully shuts down the server.  It closes all listeners and
+// any connections which have yet to send their request header, refuses any
+// sessions queued under the OverloadQueue policy, then waits for the handlers
+// of active sessions to return.  If ctx is done first, the
+// remaining sessions are closed forcibly and ctx.Err() is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.startShutdownLocked()
+	err := s.closeListenersLocked()
+	s.closeConnsLocked()
+	s.mu.Unlock()
+
+	interval := 10 * time.Millisecond
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+	for {
+		if s.openSessions() == 0 {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			s.closeSessions()
+			return ctx.Err()
+		case <-timer.C:
+			if interval < 500*time.Millisecond {
+				interval *= 2
+			}
+			timer.Reset(interval)
+		}
+	}
+}
+
+// Close immediately closes all listeners, connections and active sessions.
+// For a graceful shutdown, use Shutdown.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.startShutdownLocked()
+	err := s.closeListenersLocked()
+	s.mu.Unlock()
+
+	s.closeSessions()
+	return err
+}
+
+// ActiveSessions returns the number of sessions whose handlers are running.
+// Sessions waiting under the OverloadQueue policy are not included (see
+// QueuedSessions).
+func (s *Server) ActiveSessions() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.active
+}
+
+// openSessions returns the number of open connections, whether active,
+// queued, being refused or yet to become sessions
+func (s *Server) openSessions() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.conns) + len(s.sessions)
+}
+
+// sessionAttrs returns the attributes with which the server logs records
+// about the given session
+func (s *Server) sessionAttrs(a *AGI) []any {
+	return append(a.logAttrs(), slog.String("script", a.Script()))
+}
+
+func (s *Server) closeSessions() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closeConnsLocked()
+	for a := range s.sessions {
+		a.Close() // nolint: errcheck
+	}
+}
+
+func (s *Server) closeConnsLocked() {
+	for conn := range s.conns {
+		conn.Close() // nolint: errcheck
+	}
+}
+
+func (s *Server) closeListenersLocked() error {
+	var err error
+	for l := range s.listeners {
+		if cerr := (*l).Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// trackListener adds or removes the given listener from the set to be closed
+// on shutdown.  It returns false if a listener cannot be added because the
+// server is shutting down.
+func (s *Server) trackListener(l *net.Listener, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if add {
+		if s.inShutdown {
+			return false
+		}
+		if s.listeners == nil {
+			s.listeners = make(map[*net.Listener]struct{})
+		}
+		s.listeners[l] = struct{}{}
+	} else {
+		delete(s.listeners, l)
+	}
+	return true
+}
+
+// trackConn adds or removes the given connection from the set of those
+// accepted but not yet sessions, which are closed on shutdown, noting the
+// time of accept.  It returns
+// false if a connection cannot be added because the server is shutting down.
+func (s *Server) trackConn(conn net.Conn, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if add {
+		if s.inShutdown {
+			return false
+		}
+		if s.conns == nil {
+			s.conns = make(map[net.Conn]time.Time)
+		}
+		s.conns[conn] = time.Now()
+	} else {
+		delete(s.conns, conn)
+	}
+	return true
+}
+
+// trackSession adds or removes the given session from the set of active
+// sessions, taking its connection, and its time of accept, from the set
+// tracked by trackConn.  It returns false if a session cannot be added
+// because the server is shutting down.
+func (s *Server) trackSession(a *AGI, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if add {
+		if s.inShutdown {
+			return false
+		}
+		if s.sessions == nil {
+			s.sessions = make(map[*AGI]*sessionEntry)
+		}
+		start, ok := s.conns[a.conn]
+		if !ok {
+			start = time.Now()
+		}
+		delete(s.conns, a.conn)
+		s.lastID++
+		s.sessions[a] = newSessionEntry(a, s.lastID, start)
+	} else {
+		delete(s.sessions, a)
+	}
+	return true
+}
+
+// startShutdownLocked marks the server as shutting down, waking any
+// sessions waiting on doneChan.  The caller must hold s.mu.
+func (s *Server) startShutdownLocked() {
+	s.inShutdown = true
+	if s.done == nil {
+		s.done = make(chan struct{})
+	}
+	select {
+	case <-s.done:
+	default:
+		close(s.done)
+	}
+}
+
+// doneChan returns a channel which is closed when the server starts to shut
+// down
+func (s *Server) doneChan() <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.done == nil {
+		s.done = make(chan struct{})
+	}
+	return s.done
+}
+
+func (s *Server) shuttingDown() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.inShutdown
+}
+
+func (s *Server) headerTimeout() time.Duration {
+	if s.HeaderTimeout > 0 {
+		return s.HeaderTimeout
+	}
+	return DefaultHeaderTimeout
+}
+
+func (s *Server) logger() *slog.Logger {
+	if s.Logger != nil {
+		return s.Logger
+	}
+	return slog.Default()
+}
+
+// isTemporary indicates whether the given accept error is temporary, and
+// may be retried.
+func isTemporary(err error) bool {
+	var te interface{ Temporary() bool }
+	return errors.As(err, &te) && te.Temporary()
+}
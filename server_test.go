@@ -0,0 +1,237 @@
+package agi
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startServer serves srv on a local TCP port for the duration of the test,
+// returning the address.
+func startServer(t *testing.T, srv *Server) string {
+	t.Helper()
+
+	if srv.Logger == nil {
+		srv.Logger = discardLogger()
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(l) // nolint: errcheck
+	t.Cleanup(func() {
+		srv.Close() // nolint: errcheck
+	})
+	return l.Addr().String()
+}
+
+func discardLogger() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, nil))
+}
+
+// asteriskConn is a FastAGI connection from a fake Asterisk to a Server
+type asteriskConn struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// dialServer connects to the server at addr and sends a FastAGI header with
+// the given variables, as name/value pairs.
+func dialServer(t *testing.T, addr string, vars ...string) *asteriskConn {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close() // nolint: errcheck
+	})
+
+	header := "agi_network: yes\n"
+	for i := 0; i+1 < len(vars); i += 2 {
+		header += vars[i] + ": " + vars[i+1] + "\n"
+	}
+	if _, err := conn.Write([]byte(header + "\n")); err != nil {
+		t.Fatal(err)
+	}
+	return &asteriskConn{t: t, conn: conn, r: bufio.NewReader(conn)}
+}
+
+// next reads the next command from the server, answering it with the given
+// reply unless that is empty.  It returns the command, or "" once the server
+// has closed the connection.
+func (c *asteriskConn) next(reply string) string {
+	c.t.Helper()
+
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second)) // nolint: errcheck
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return ""
+	}
+	if reply != "" {
+		c.conn.Write([]byte(reply + "\n")) // nolint: errcheck
+	}
+	return strings.TrimSuffix(line, "\n")
+}
+
+// closed waits for the server to close the connection, ignoring any further
+// commands, and reports whether it did so in time.
+func (c *asteriskConn) closed() bool {
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second)) // nolint: errcheck
+	for {
+		if _, err := c.r.ReadString('\n'); err != nil {
+			return !isTimeout(err)
+		}
+	}
+}
+
+func isTimeout(err error) bool {
+	nerr, ok := err.(net.Error)
+	return ok && nerr.Timeout()
+}
+
+// waitFor polls cond until it holds, failing the test after a while
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	for deadline := time.Now().Add(5 * time.Second); !cond(); {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestServer(t *testing.T) {
+	srv := &Server{
+		Handler: HandlerFunc(func(a *AGI) {
+			a.Verbose("hello "+a.Variables["agi_channel"], 1) // nolint: errcheck
+		}),
+		StatusVariable: "AGI_RESULT",
+	}
+	addr := startServer(t, srv)
+
+	c := dialServer(t, addr, "agi_channel", "SIP/1")
+	if got := c.next("200 result=1"); got != `VERBOSE "hello SIP/1" 1` {
+		t.Errorf("got %q", got)
+	}
+	if got := c.next("200 result=1"); got != "SET VARIABLE AGI_RESULT SUCCESS" {
+		t.Errorf("got %q", got)
+	}
+	if !c.closed() {
+		t.Error("connection not closed after handler returned")
+	}
+}
+
+// dialSilent connects to the server at addr without sending a header
+func dialSilent(t *testing.T, addr string) *asteriskConn {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close() // nolint: errcheck
+	})
+	return &asteriskConn{t: t, conn: conn, r: bufio.NewReader(conn)}
+}
+
+func TestServerHeaderTimeout(t *testing.T) {
+	called := make(chan struct{}, 1)
+	srv := &Server{
+		Handler: HandlerFunc(func(a *AGI) {
+			called <- struct{}{}
+		}),
+		HeaderTimeout: 50 * time.Millisecond,
+	}
+	addr := startServer(t, srv)
+
+	c := dialSilent(t, addr)
+	if !c.closed() {
+		t.Fatal("silent connection not closed")
+	}
+	select {
+	case <-called:
+		t.Error("handler called without a header")
+	default:
+	}
+	waitFor(t, "connection to be untracked", func() bool { return srv.openSessions() == 0 })
+}
+
+func TestServerShutdown(t *testing.T) {
+	release := make(chan struct{})
+	srv := &Server{
+		Handler: HandlerFunc(func(a *AGI) {
+			<-release
+		}),
+	}
+	addr := startServer(t, srv)
+
+	busy := dialServer(t, addr)
+	waitFor(t, "active session", func() bool { return srv.ActiveSessions() == 1 })
+	silent := dialSilent(t, addr)
+	waitFor(t, "silent connection", func() bool { return srv.openSessions() == 2 })
+
+	done := make(chan error, 1)
+	go func() {
+		done <- srv.Shutdown(context.Background())
+	}()
+
+	// Connections yet to send a header are closed at once, while active
+	// sessions are left to finish
+	if !silent.closed() {
+		t.Error("silent connection not closed on shutdown")
+	}
+	select {
+	case err := <-done:
+		t.Fatalf("Shutdown returned %v before the session finished", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	if !busy.closed() {
+		t.Error("session not closed")
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Shutdown: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Shutdown did not return")
+	}
+
+	if _, err := net.Dial("tcp", addr); err == nil {
+		t.Error("listener still open after shutdown")
+	}
+}
+
+func TestServerShutdownTimeout(t *testing.T) {
+	srv := &Server{
+		Handler: HandlerFunc(func(a *AGI) {
+			<-a.Done()
+		}),
+	}
+	addr := startServer(t, srv)
+
+	busy := dialServer(t, addr)
+	waitFor(t, "active session", func() bool { return srv.ActiveSessions() == 1 })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Shutdown = %v, want context.DeadlineExceeded", err)
+	}
+	if !busy.closed() {
+		t.Error("session not closed forcibly")
+	}
+}
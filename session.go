@@ -0,0 +1,221 @@
+package agi
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// aLongTimeAgo is a non-zero time in the past, used to interrupt blocked
+// writes immediately.
+var aLongTimeAgo = time.Unix(1, 0)
+
+// writeDeadliner is implemented by writers which support write deadlines,
+// such as net.Conn and (some) *os.File.
+type writeDeadliner interface {
+	SetWriteDeadline(t time.Time) error
+}
+
+// reply is a single framed reply read from the AGI stream
+type reply struct {
+	lines []string
+	err   error
+}
+
+// readLoop owns the buffered reader for the lifetime of the session.  It
+// frames the inbound stream into replies and delivers each one to the oldest
+// command still awaiting a reply.  Replies to commands which have been
+// abandoned are delivered to channels nobody reads, and are thereby
+// discarded.  Asynchronous hangup notices are consumed here, whether or not a
+// command is outstanding.
+func (a *AGI) readLoop() {
+	for {
+		rep := a.readReply()
+
+		if rep.err == nil && strings.HasPrefix(rep.lines[0], "HANGUP") {
+			a.hangup(ErrHangup)
+			continue
+		}
+
+		a.pmu.Lock()
+		if rep.err != nil {
+			a.rerr = rep.err
+			pending := a.pending
+			a.pending = nil
+			a.pmu.Unlock()
+
+			a.hangup(rep.err)
+
+			for _, ch := range pending {
+				ch <- rep
+			}
+			return
+		}
+		if len(a.pending) == 0 {
+			// Nobody has asked for this yet; hold it for the next command
+			a.unclaimed = append(a.unclaimed, rep)
+			a.pmu.Unlock()
+			continue
+		}
+		// Shift the queue down, rather than reslicing, so that its array
+		// is reused
+		ch := a.pending[0]
+		n := copy(a.pending, a.pending[1:])
+		a.pending[n] = nil
+		a.pending = a.pending[:n]
+		a.pmu.Unlock()
+
+		ch <- rep
+	}
+}
+
+// readReply reads a single reply, which may span several lines, from the
+// inbound stream.
+func (a *AGI) readReply() reply {
+	line, err := a.readLine()
+	if err != nil {
+		return reply{err: err}
+	}
+	rep := reply{lines: []string{line}}
+
+	// Usage blocks run up to and including the "520 End of proper usage." line
+	if strings.HasPrefix(line, "520-") {
+		for {
+			line, err = a.readLine()
+			if err != nil {
+				return reply{err: errors.Wrap(err, "failed to read usage")}
+			}
+			rep.lines = append(rep.lines, line)
+			if strings.HasPrefix(line, "520 ") {
+				break
+			}
+		}
+	}
+	return rep
+}
+
+// send writes the given command lines to Asterisk, all at once, and returns
+// the channels on which their replies will be delivered, in order, appended
+// to dst.  The caller must hold a.mu.
+func (a *AGI) send(ctx context.Context, dst []chan reply, lines ...string) ([]chan reply, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, &CommandError{Kind: ErrCanceled, Err: errors.Wrap(err, "command not sent")}
+	}
+	if a.werr != nil {
+		return nil, &CommandError{Kind: ErrTransport, Err: errors.Wrap(a.werr, "session output failed")}
+	}
+
+	// Register for the replies before writing, since they may arrive
+	// before the write returns.
+	chs := dst
+	a.pmu.Lock()
+	for range lines {
+		ch := a.spare
+		if ch != nil {
+			a.spare = nil
+		} else {
+			ch = make(chan reply, 1)
+		}
+		chs = append(chs, ch)
+
+		switch {
+		case len(a.unclaimed) > 0:
+			ch <- a.unclaimed[0]
+			a.unclaimed = a.unclaimed[1:]
+		case a.rerr != nil:
+			a.pmu.Unlock()
+			return nil, &CommandError{Kind: ErrTransport, Err: errors.Wrap(a.rerr, "session input failed")}
+		default:
+			a.pending = append(a.pending, ch)
+		}
+	}
+	a.pmu.Unlock()
+
+	if err := a.writeLinesContext(ctx, lines); err != nil {
+		// Some part of the lines may have been written, so the stream can
+		// no longer be trusted.
+		a.werr = err
+		return nil, &CommandError{Kind: ErrTransport, Err: errors.Wrap(err, "failed to send command")}
+	}
+	return chs, nil
+}
+
+// writeLinesContext writes the given lines to the session's output stream,
+// giving up if ctx is done first (where the underlying writer supports
+// write deadlines).
+func (a *AGI) writeLinesContext(ctx context.Context, lines []string) error {
+	if a.wd != nil && ctx.Done() != nil {
+		if deadline, ok := ctx.Deadline(); ok {
+			a.wd.SetWriteDeadline(deadline) // nolint: errcheck
+		}
+
+		stop := make(chan struct{})
+		exited := make(chan struct{})
+		go func() {
+			defer close(exited)
+			select {
+			case <-ctx.Done():
+				a.wd.SetWriteDeadline(aLongTimeAgo) // nolint: errcheck
+			case <-stop:
+			}
+		}()
+		defer func() {
+			close(stop)
+			<-exited
+			a.wd.SetWriteDeadline(time.Time{}) // nolint: errcheck
+		}()
+	}
+
+	err := a.writeLines(lines)
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// readLine reads a single line from the session's buffered reader, stripping
+// the line terminator.  A final line which is not terminated before EOF is
+// still returned.
+func (a *AGI) readLine() (string, error) {
+	b, err := a.r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		// The line is longer than the buffer; accumulate the fragments.
+		buf := append([]byte(nil), b...)
+		for err == bufio.ErrBufferFull {
+			b, err = a.r.ReadSlice('\n')
+			buf = append(buf, b...)
+		}
+		b = buf
+	}
+	if err != nil && (err != io.EOF || len(b) == 0) {
+		return "", err
+	}
+
+	line := string(bytes.TrimRight(b, "\r\n"))
+	a.record(FromAsterisk, line)
+	return line, nil
+}
+
+// writeLines writes the given lines to the session's output stream and
+// flushes them.  The lines are recorded in the transcript first, since a
+// reply may be read, and recorded, as soon as they are flushed.
+func (a *AGI) writeLines(lines []string) error {
+	for _, line := range lines {
+		a.record(ToAsterisk, line)
+	}
+
+	for _, line := range lines {
+		if _, err := a.w.WriteString(line); err != nil {
+			return err
+		}
+		if err := a.w.WriteByte('\n'); err != nil {
+			return err
+		}
+	}
+	return a.w.Flush()
+}
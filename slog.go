@@ -0,0 +1,77 @@
+package agi
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// SetLogHandler attaches a structured log handler to the session.  Each
+// command is logged, at debug level if it succeeded or at warn level if it
+// failed, with the attributes "command", "status", "result", "value",
+// "duration" and (on failure) "error".  Every record is tagged with the
+// session's "agi_uniqueid" and "agi_channel" variables and, for FastAGI, its
+// "remote_addr".  The session variables are logged once, at debug level, when
+// the handler is attached.
+//
+// Passing nil detaches any existing handler.
+func (a *AGI) SetLogHandler(h slog.Handler) error {
+	if h == nil {
+		a.slog = nil
+		return nil
+	}
+	if a.slog != nil {
+		return errors.New("Log handler already attached")
+	}
+	a.slog = slog.New(h).With(a.logAttrs()...)
+
+	if a.slog.Enabled(context.Background(), slog.LevelDebug) {
+		vars := make([]any, 0, len(a.Variables))
+		for k, v := range a.Variables {
+			vars = append(vars, slog.String(k, v))
+		}
+		a.slog.Debug("AGI session", slog.Group("variables", vars...))
+	}
+
+	return nil
+}
+
+// logAttrs returns the attributes which identify the session in log records.
+func (a *AGI) logAttrs() []any {
+	var attrs []any
+	for _, k := range []string{"agi_uniqueid", "agi_channel"} {
+		if v, ok := a.Variables[k]; ok {
+			attrs = append(attrs, slog.String(k, v))
+		}
+	}
+	if a.conn != nil {
+		attrs = append(attrs, slog.String("remote_addr", a.conn.RemoteAddr().String()))
+	}
+	return attrs
+}
+
+// logCommand logs the given command and its response to the session's
+// structured logger.
+func (a *AGI) logCommand(ctx context.Context, cmd string, resp *Response, dur time.Duration) {
+	level := slog.LevelDebug
+	if resp.Error != nil {
+		level = slog.LevelWarn
+	}
+	if !a.slog.Enabled(ctx, level) {
+		return
+	}
+
+	attrs := []slog.Attr{
+		slog.String("command", cmd),
+		slog.Int("status", resp.Status),
+		slog.Int("result", resp.Result),
+		slog.String("value", resp.Value),
+		slog.Duration("duration", dur),
+	}
+	if resp.Error != nil {
+		attrs = append(attrs, slog.String("error", resp.Error.Error()))
+	}
+	a.slog.LogAttrs(ctx, level, "AGI command", attrs...)
+}
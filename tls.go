@@ -0,0 +1,189 @@
+package agi
+
+import (
+	"context"
+	"crypto/tls"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ListenAndServeTLS listens on the TCP address s.Addr and then calls
+// ServeTLS.  It always returns a non-nil error; after Shutdown or Close,
+// ErrServerClosed.
+func (s *Server) ListenAndServeTLS(certFile, keyFile string) error {
+	if s.shuttingDown() {
+		return ErrServerClosed
+	}
+
+	addr := s.Addr
+	if addr == "" {
+		addr = "localhost:4573"
+	}
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return errors.Wrap(err, "failed to bind server")
+	}
+	return s.ServeTLS(l, certFile, keyFile)
+}
+
+// ServeTLS accepts FastAGI connections over TLS on the given listener, as
+// Serve.  The server's TLSConfig is used, if set; to require client
+// certificates, set its ClientAuth and ClientCAs.
+//
+// If certFile and keyFile are given, the certificate is loaded from them
+// and reloaded whenever they change on disk (see CertReloader).  Otherwise,
+// TLSConfig must supply the certificate.
+func (s *Server) ServeTLS(l net.Listener, certFile, keyFile string) error {
+	var config *tls.Config
+	if s.TLSConfig != nil {
+		config = s.TLSConfig.Clone()
+	} else {
+		config = new(tls.Config)
+	}
+
+	if certFile != "" || keyFile != "" {
+		cr, err := NewCertReloader(certFile, keyFile)
+		if err != nil {
+			l.Close() // nolint: errcheck
+			return err
+		}
+		config.Certificates = nil
+		config.GetCertificate = cr.GetCertificate
+	}
+	if len(config.Certificates) == 0 && config.GetCertificate == nil && config.GetConfigForClient == nil {
+		l.Close() // nolint: errcheck
+		return errors.New("no TLS certificate configured")
+	}
+
+	return s.Serve(tls.NewListener(l, config))
+}
+
+// handshake completes the TLS handshake of the given connection, if it is a
+// TLS connection, so that a failed handshake is logged and never reaches the
+// handler.  The handshake fails if it is not complete by the given deadline.
+func (s *Server) handshake(conn net.Conn, deadline time.Time) bool {
+	tc, ok := conn.(*tls.Conn)
+	if !ok {
+		return true
+	}
+
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+
+	if err := tc.HandshakeContext(ctx); err != nil {
+		s.logger().Warn("TLS handshake failed", slog.String("remote_addr", conn.RemoteAddr().String()), slog.String("error", err.Error()))
+		s.connEvent(conn, ConnHandshakeFailed)
+		conn.Close() // nolint: errcheck
+		return false
+	}
+	return true
+}
+
+// CertReloader holds a TLS certificate loaded from disk, reloading it when
+// the certificate or key file changes.  Its GetCertificate method may be used
+// in a tls.Config.
+type CertReloader struct {
+	certFile string
+	keyFile  string
+
+	// CheckInterval is the minimum time between checks of the files for
+	// changes.  Defaults to DefaultCertCheckInterval.
+	CheckInterval time.Duration
+
+	mu        sync.Mutex
+	cert      *tls.Certificate
+	certMod   time.Time
+	keyMod    time.Time
+	lastCheck time.Time
+}
+
+// DefaultCertCheckInterval is the default minimum time between checks of a
+// CertReloader's files for changes
+const DefaultCertCheckInterval = 10 * time.Second
+
+// NewCertReloader loads the given certificate and key files
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	cr := &CertReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	if err := cr.Reload(); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+// Reload loads the certificate and key files afresh.  If they cannot be
+// loaded, the previous certificate remains in use.
+func (cr *CertReloader) Reload() error {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+
+	return cr.reloadLocked()
+}
+
+func (cr *CertReloader) reloadLocked() error {
+	certMod, keyMod, err := cr.modTimes()
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return errors.Wrap(err, "failed to load TLS certificate")
+	}
+
+	cr.cert = &cert
+	cr.certMod = certMod
+	cr.keyMod = keyMod
+	cr.lastCheck = time.Now()
+	return nil
+}
+
+// GetCertificate returns the current certificate, first reloading it if the
+// files have changed since they were last loaded.  It implements
+// tls.Config.GetCertificate.
+func (cr *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+
+	interval := cr.CheckInterval
+	if interval == 0 {
+		interval = DefaultCertCheckInterval
+	}
+	if time.Since(cr.lastCheck) < interval {
+		return cr.cert, nil
+	}
+	cr.lastCheck = time.Now()
+
+	certMod, keyMod, err := cr.modTimes()
+	if err != nil || (certMod.Equal(cr.certMod) && keyMod.Equal(cr.keyMod)) {
+		// Keep serving the certificate we have
+		return cr.cert, nil
+	}
+	cr.reloadLocked() // nolint: errcheck
+
+	return cr.cert, nil
+}
+
+func (cr *CertReloader) modTimes() (certMod, keyMod time.Time, err error) {
+	fi, err := os.Stat(cr.certFile)
+	if err != nil {
+		return certMod, keyMod, errors.Wrap(err, "failed to read TLS certificate")
+	}
+	certMod = fi.ModTime()
+
+	fi, err = os.Stat(cr.keyFile)
+	if err != nil {
+		return certMod, keyMod, errors.Wrap(err, "failed to read TLS key")
+	}
+	keyMod = fi.ModTime()
+
+	return certMod, keyMod, nil
+}
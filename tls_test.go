@@ -0,0 +1,294 @@
+package agi
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testCA is a certificate authority generated for a test
+type testCA struct {
+	t    *testing.T
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "agi test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &testCA{t: t, cert: cert, key: key, pool: pool}
+}
+
+// issue returns PEM-encoded certificate and key for the given common name,
+// signed by the CA, usable by both servers (for 127.0.0.1) and clients.
+func (ca *testCA) issue(name string, serial int64) (certPEM, keyPEM []byte) {
+	ca.t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+// keyPair returns a tls.Certificate for the given common name
+func (ca *testCA) keyPair(name string) tls.Certificate {
+	ca.t.Helper()
+
+	cert, err := tls.X509KeyPair(ca.issue(name, 2))
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	return cert
+}
+
+// startTLSServer serves srv over TLS on a local TCP port for the duration of
+// the test, returning the address.
+func startTLSServer(t *testing.T, srv *Server, certFile, keyFile string) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if srv.Logger == nil {
+		srv.Logger = discardLogger()
+	}
+	go srv.ServeTLS(l, certFile, keyFile) // nolint: errcheck
+	t.Cleanup(func() {
+		srv.Close() // nolint: errcheck
+	})
+	return l.Addr().String()
+}
+
+// dialTLS connects to the TLS server at addr and sends a FastAGI header
+func dialTLS(t *testing.T, addr string, config *tls.Config) *asteriskConn {
+	t.Helper()
+
+	conn, err := tls.Dial("tcp", addr, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close() // nolint: errcheck
+	})
+	if _, err := conn.Write([]byte("agi_network: yes\n\n")); err != nil {
+		t.Fatal(err)
+	}
+	return &asteriskConn{t: t, conn: conn, r: bufio.NewReader(conn)}
+}
+
+// connEvents records the events reported to a Server's ConnHook
+type connEvents struct {
+	mu     sync.Mutex
+	events []ConnEvent
+}
+
+func (e *connEvents) hook(conn net.Conn, event ConnEvent) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.events = append(e.events, event)
+}
+
+func (e *connEvents) has(event ConnEvent) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, ev := range e.events {
+		if ev == event {
+			return true
+		}
+	}
+	return false
+}
+
+func verboseHandler(a *AGI) {
+	a.Verbose("hello", 1) // nolint: errcheck
+}
+
+func TestServeTLS(t *testing.T) {
+	ca := newTestCA(t)
+	srv := &Server{
+		Handler:   HandlerFunc(verboseHandler),
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{ca.keyPair("server")}},
+	}
+	addr := startTLSServer(t, srv, "", "")
+
+	c := dialTLS(t, addr, &tls.Config{RootCAs: ca.pool})
+	if got := c.next("200 result=1"); got != "VERBOSE hello 1" {
+		t.Errorf("got %q", got)
+	}
+	if !c.closed() {
+		t.Error("connection not closed after handler returned")
+	}
+}
+
+func TestServeTLSClientCert(t *testing.T) {
+	ca := newTestCA(t)
+	var events connEvents
+	srv := &Server{
+		Handler: HandlerFunc(verboseHandler),
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{ca.keyPair("server")},
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+			ClientCAs:    ca.pool,
+		},
+		ConnHook: events.hook,
+	}
+	addr := startTLSServer(t, srv, "", "")
+
+	// Under TLS 1.3, the client learns of the rejection of its certificate
+	// only once it reads.
+	anon := dialTLS(t, addr, &tls.Config{RootCAs: ca.pool})
+	if got := anon.next("200 result=1"); got != "" {
+		t.Errorf("client without certificate was served %q", got)
+	}
+	waitFor(t, "handshake failure", func() bool { return events.has(ConnHandshakeFailed) })
+
+	c := dialTLS(t, addr, &tls.Config{RootCAs: ca.pool, Certificates: []tls.Certificate{ca.keyPair("asterisk")}})
+	if got := c.next("200 result=1"); got != "VERBOSE hello 1" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestServeTLSHandshakeTimeout(t *testing.T) {
+	ca := newTestCA(t)
+	var events connEvents
+	srv := &Server{
+		Handler:       HandlerFunc(verboseHandler),
+		TLSConfig:     &tls.Config{Certificates: []tls.Certificate{ca.keyPair("server")}},
+		HeaderTimeout: 50 * time.Millisecond,
+		ConnHook:      events.hook,
+	}
+	addr := startTLSServer(t, srv, "", "")
+
+	// A client which never starts the handshake
+	c := dialSilent(t, addr)
+	if !c.closed() {
+		t.Fatal("connection not closed")
+	}
+	waitFor(t, "handshake failure", func() bool { return events.has(ConnHandshakeFailed) })
+}
+
+func TestCertReloader(t *testing.T) {
+	ca := newTestCA(t)
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+
+	write := func(serial int64, mod time.Time) {
+		certPEM, keyPEM := ca.issue("server", serial)
+		for file, data := range map[string][]byte{certFile: certPEM, keyFile: keyPEM} {
+			if err := os.WriteFile(file, data, 0o600); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chtimes(file, mod, mod); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	serial := func(cert *tls.Certificate) int64 {
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return leaf.SerialNumber.Int64()
+	}
+
+	write(10, time.Now().Add(-time.Minute))
+	cr, err := NewCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cr.CheckInterval = time.Millisecond
+
+	cert, err := cr.GetCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := serial(cert); got != 10 {
+		t.Fatalf("serial = %d, want 10", got)
+	}
+
+	write(11, time.Now())
+	time.Sleep(5 * time.Millisecond)
+
+	cert, err = cr.GetCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := serial(cert); got != 11 {
+		t.Errorf("serial after rewrite = %d, want 11", got)
+	}
+
+	// A broken rewrite leaves the last good certificate in use
+	if err := os.WriteFile(keyFile, []byte("garbage"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(keyFile, time.Now().Add(time.Minute), time.Now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * time.Millisecond)
+
+	cert, err = cr.GetCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := serial(cert); got != 11 {
+		t.Errorf("serial after broken rewrite = %d, want 11", got)
+	}
+}
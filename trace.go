@@ -0,0 +1,225 @@
+package agi
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Tracer starts trace spans.  Its shape mirrors that of the OpenTelemetry
+// tracing API, so that an adapter is a thin wrapper:
+//
+//	type otelTracer struct{ t trace.Tracer }
+//
+//	func (o otelTracer) Start(ctx context.Context, name string, attrs ...agi.Attribute) (context.Context, agi.Span) {
+//		ctx, span := o.t.Start(ctx, name, trace.WithAttributes(toKeyValues(attrs)...))
+//		return ctx, otelSpan{span}
+//	}
+//
+// where otelSpan forwards SetAttributes, RecordError and End to the
+// OpenTelemetry span.
+type Tracer interface {
+	// Start starts a span as a child of any span carried by ctx, returning
+	// a context which carries the new span.
+	Start(ctx context.Context, name string, attrs ...Attribute) (context.Context, Span)
+}
+
+// Span is a single timed operation within a trace
+type Span interface {
+	// SetAttributes sets the given attributes on the span
+	SetAttributes(attrs ...Attribute)
+
+	// RecordError records the given error against the span
+	RecordError(err error)
+
+	// End completes the span
+	End()
+}
+
+// Attribute is a key/value pair attached to a span.  Values are strings,
+// ints, int64s or bools.
+type Attribute struct {
+	Key   string
+	Value interface{}
+}
+
+// SetTracer attaches a tracer to the session.  A root span named "agi.session"
+// is started at once, carrying the session's agi_* variables as attributes,
+// and is ended when the session is closed.  Each command is then traced as a
+// child span named for the command (such as "GET VARIABLE"), with the
+// attributes "agi.command", "agi.status", "agi.result" and "agi.idle_ms" (the
+// time the handler spent since the previous command completed).
+func (a *AGI) SetTracer(t Tracer) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	attrs := make([]Attribute, 0, len(a.Variables))
+	for k, v := range a.Variables {
+		attrs = append(attrs, Attribute{Key: k, Value: v})
+	}
+
+	ctx, span := t.Start(context.Background(), "agi.session", attrs...)
+
+	a.tracer = t
+	a.traceCtx = ctx
+	a.lastCommand = time.Now()
+
+	a.tmu.Lock()
+	a.traceSpan = span
+	a.tmu.Unlock()
+}
+
+// startCommandSpan starts the span for the given command.  The caller must
+// hold a.mu.
+func (a *AGI) startCommandSpan(cmd string) Span {
+	_, span := a.tracer.Start(a.traceCtx, commandVerb(cmd),
+		Attribute{Key: "agi.command", Value: cmd},
+		Attribute{Key: "agi.idle_ms", Value: time.Since(a.lastCommand).Milliseconds()},
+	)
+	return span
+}
+
+// endCommandSpan records the given response against the span and ends it.
+// The caller must hold a.mu.
+func (a *AGI) endCommandSpan(span Span, resp *Response) {
+	span.SetAttributes(
+		Attribute{Key: "agi.status", Value: resp.Status},
+		Attribute{Key: "agi.result", Value: resp.Result},
+	)
+	if resp.Error != nil {
+		span.RecordError(resp.Error)
+	}
+	span.End()
+	a.lastCommand = time.Now()
+}
+
+// endTrace ends the session span, if any.
+func (a *AGI) endTrace() {
+	a.tmu.Lock()
+	defer a.tmu.Unlock()
+
+	if a.traceSpan != nil {
+		a.traceSpan.End()
+		a.traceSpan = nil
+	}
+}
+
+// MemoryTracer is a Tracer which records spans in memory, for inspection in
+// tests.
+type MemoryTracer struct {
+	mu    sync.Mutex
+	spans []*memorySpan
+}
+
+// RecordedSpan is a snapshot of a span recorded by a MemoryTracer
+type RecordedSpan struct {
+	// Name is the name of the span
+	Name string
+
+	// Parent is the span's parent, if any
+	Parent *RecordedSpan
+
+	// Attributes are the attributes set on the span
+	Attributes map[string]interface{}
+
+	// Errors are the errors recorded against the span
+	Errors []error
+
+	// StartTime is the time at which the span started
+	StartTime time.Time
+
+	// EndTime is the time at which the span ended, or zero if it has not
+	EndTime time.Time
+}
+
+// memorySpan is a live span of a MemoryTracer.  Its fields are protected by
+// the tracer's mu.
+type memorySpan struct {
+	tracer *MemoryTracer
+	parent *memorySpan
+
+	// rec is the span as recorded so far; its Parent is not set
+	rec RecordedSpan
+}
+
+type memorySpanKey struct{}
+
+// Start implements Tracer
+func (t *MemoryTracer) Start(ctx context.Context, name string, attrs ...Attribute) (context.Context, Span) {
+	s := &memorySpan{
+		tracer: t,
+		rec: RecordedSpan{
+			Name:       name,
+			Attributes: make(map[string]interface{}),
+			StartTime:  time.Now(),
+		},
+	}
+	s.parent, _ = ctx.Value(memorySpanKey{}).(*memorySpan) // nolint: errcheck
+	s.SetAttributes(attrs...)
+
+	t.mu.Lock()
+	t.spans = append(t.spans, s)
+	t.mu.Unlock()
+
+	return context.WithValue(ctx, memorySpanKey{}, s), s
+}
+
+// Spans returns a snapshot of the spans recorded so far, in the order in
+// which they were started.  Later changes to the spans are not reflected in
+// it.
+func (t *MemoryTracer) Spans() []*RecordedSpan {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	copies := make(map[*memorySpan]*RecordedSpan, len(t.spans))
+	list := make([]*RecordedSpan, 0, len(t.spans))
+	for _, s := range t.spans {
+		c := s.rec
+		c.Attributes = make(map[string]interface{}, len(s.rec.Attributes))
+		for k, v := range s.rec.Attributes {
+			c.Attributes[k] = v
+		}
+		c.Errors = append([]error(nil), s.rec.Errors...)
+		c.Parent = copies[s.parent] // parents start before their children
+
+		copies[s] = &c
+		list = append(list, &c)
+	}
+	return list
+}
+
+// Reset discards all recorded spans
+func (t *MemoryTracer) Reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.spans = nil
+}
+
+// SetAttributes implements Span
+func (s *memorySpan) SetAttributes(attrs ...Attribute) {
+	s.tracer.mu.Lock()
+	defer s.tracer.mu.Unlock()
+
+	for _, attr := range attrs {
+		s.rec.Attributes[attr.Key] = attr.Value
+	}
+}
+
+// RecordError implements Span
+func (s *memorySpan) RecordError(err error) {
+	s.tracer.mu.Lock()
+	defer s.tracer.mu.Unlock()
+
+	s.rec.Errors = append(s.rec.Errors, err)
+}
+
+// End implements Span
+func (s *memorySpan) End() {
+	s.tracer.mu.Lock()
+	defer s.tracer.mu.Unlock()
+
+	if s.rec.EndTime.IsZero() {
+		s.rec.EndTime = time.Now()
+	}
+}
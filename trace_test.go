@@ -0,0 +1,70 @@
+package agi
+
+import (
+	"testing"
+)
+
+func TestMemoryTracer(t *testing.T) {
+	a, f := newFakeSession(t, "agi_channel", "SIP/100", "agi_uniqueid", "1700000000.1")
+
+	var tracer MemoryTracer
+	a.SetTracer(&tracer)
+
+	go func() {
+		f.expect("GET VARIABLE FOO")
+		f.reply("200 result=1 (bar)")
+		f.expect("BOGUS")
+		f.reply("510 Invalid or unknown command")
+	}()
+
+	if v, err := a.Get("FOO"); err != nil || v != "bar" {
+		t.Fatalf("Get = %q, %v", v, err)
+	}
+	if a.Command("BOGUS").Error == nil {
+		t.Fatal("no error from an invalid command")
+	}
+	a.Close() // nolint: errcheck
+
+	spans := tracer.Spans()
+	if len(spans) != 3 {
+		t.Fatalf("recorded %d spans, want 3", len(spans))
+	}
+
+	root := spans[0]
+	if root.Name != "agi.session" || root.Parent != nil || root.EndTime.IsZero() {
+		t.Errorf("root span = %+v", root)
+	}
+	if root.Attributes["agi_channel"] != "SIP/100" || root.Attributes["agi_uniqueid"] != "1700000000.1" {
+		t.Errorf("root attributes = %v", root.Attributes)
+	}
+
+	get := spans[1]
+	if get.Name != "GET VARIABLE" || get.Parent != root || get.EndTime.IsZero() {
+		t.Errorf("command span = %+v", get)
+	}
+	if get.Attributes["agi.command"] != "GET VARIABLE FOO" || get.Attributes["agi.status"] != 200 || get.Attributes["agi.result"] != 1 {
+		t.Errorf("command attributes = %v", get.Attributes)
+	}
+	if _, ok := get.Attributes["agi.idle_ms"].(int64); !ok {
+		t.Errorf("agi.idle_ms = %#v", get.Attributes["agi.idle_ms"])
+	}
+	if len(get.Errors) != 0 {
+		t.Errorf("errors recorded against a successful command: %v", get.Errors)
+	}
+
+	bogus := spans[2]
+	if bogus.Parent != root || bogus.Attributes["agi.status"] != StatusInvalid || len(bogus.Errors) != 1 {
+		t.Errorf("failed command span = %+v", bogus)
+	}
+
+	// Spans are snapshots
+	root.Attributes["agi_channel"] = "changed"
+	if got := tracer.Spans()[0].Attributes["agi_channel"]; got != "SIP/100" {
+		t.Errorf("snapshot changed the tracer's span: agi_channel = %v", got)
+	}
+
+	tracer.Reset()
+	if n := len(tracer.Spans()); n != 0 {
+		t.Errorf("%d spans after Reset", n)
+	}
+}
@@ -0,0 +1,134 @@
+package agi
+
+import (
+	"bufio"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// transcriptMagic is the first line of every transcript, identifying its format and version
+const transcriptMagic = "# agi-transcript 1"
+
+// Direction indicates which way a line of an AGI conversation travelled
+type Direction byte
+
+const (
+	// FromAsterisk indicates a line received from Asterisk
+	FromAsterisk Direction = '<'
+
+	// ToAsterisk indicates a line sent to Asterisk
+	ToAsterisk Direction = '>'
+)
+
+// TranscriptEntry is a single line of a transcript
+type TranscriptEntry struct {
+	// Time is the time at which the line was sent or received
+	Time time.Time
+
+	// Direction indicates whether the line was sent or received
+	Direction Direction
+
+	// Line is the line itself, without its terminator
+	Line string
+}
+
+// SetTranscript tees the wire conversation of the session to the given
+// writer, starting with the initial block of variables.  Writes to w are made
+// synchronously as lines are sent and received, so w should be fast; errors
+// writing to it are ignored.  Passing nil stops the transcript.
+//
+// The transcript may be read back with ReadTranscript.  Its format is
+// line-oriented UTF-8 text.  The first line identifies the format:
+//
+//	# agi-transcript 1
+//
+// Each subsequent line records a single line of the conversation:
+//
+//	<timestamp> <direction> <line>
+//
+// where <timestamp> is the time at which the line was sent or received, in
+// RFC 3339 format with nanoseconds; <direction> is "<" for a line received
+// from Asterisk or ">" for a line sent to Asterisk; and <line> is the line
+// itself, without its terminator.  The block of agi_* variables which opens
+// the session, including the blank line which ends it, is recorded first.
+// Other lines beginning with "#" are comments, and are ignored.
+//
+//	# agi-transcript 1
+//	2026-01-02T15:04:05.000000001Z < agi_network: yes
+//	2026-01-02T15:04:05.000000002Z < agi_channel: PJSIP/100-00000001
+//	2026-01-02T15:04:05.000000003Z <
+//	2026-01-02T15:04:05.100000000Z > GET VARIABLE FOO
+//	2026-01-02T15:04:05.120000000Z < 200 result=1 (bar)
+func (a *AGI) SetTranscript(w io.Writer) {
+	a.trmu.Lock()
+	defer a.trmu.Unlock()
+
+	if w != nil && a.transcript == nil {
+		io.WriteString(w, transcriptMagic+"\n") // nolint: errcheck
+		for _, e := range a.header {
+			writeTranscriptEntry(w, e)
+		}
+	}
+	a.transcript = w
+}
+
+// record writes a line to the transcript, if there is one
+func (a *AGI) record(dir Direction, line string) {
+	a.trmu.Lock()
+	defer a.trmu.Unlock()
+
+	if a.transcript != nil {
+		writeTranscriptEntry(a.transcript, TranscriptEntry{Time: time.Now(), Direction: dir, Line: line})
+	}
+}
+
+func writeTranscriptEntry(w io.Writer, e TranscriptEntry) {
+	io.WriteString(w, e.Time.UTC().Format(time.RFC3339Nano)+" "+string(e.Direction)+" "+e.Line+"\n") // nolint: errcheck
+}
+
+// ReadTranscript reads a transcript, as written by AGI.SetTranscript, from the
+// given reader.
+func ReadTranscript(r io.Reader) ([]TranscriptEntry, error) {
+	s := bufio.NewScanner(r)
+	s.Buffer(nil, 1024*1024)
+
+	if !s.Scan() {
+		if err := s.Err(); err != nil {
+			return nil, errors.Wrap(err, "failed to read transcript")
+		}
+		return nil, errors.New("empty transcript")
+	}
+	if s.Text() != transcriptMagic {
+		return nil, errors.Errorf("not a transcript (or unsupported version): %q", s.Text())
+	}
+
+	var entries []TranscriptEntry
+	for n := 2; s.Scan(); n++ {
+		line := s.Text()
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		pieces := strings.SplitN(line, " ", 3)
+		if len(pieces) < 2 || len(pieces[1]) != 1 || (pieces[1] != string(FromAsterisk) && pieces[1] != string(ToAsterisk)) {
+			return entries, errors.Errorf("malformed transcript line %d: %q", n, line)
+		}
+		ts, err := time.Parse(time.RFC3339Nano, pieces[0])
+		if err != nil {
+			return entries, errors.Wrapf(err, "malformed timestamp on transcript line %d", n)
+		}
+
+		e := TranscriptEntry{Time: ts, Direction: Direction(pieces[1][0])}
+		if len(pieces) == 3 {
+			e.Line = pieces[2]
+		}
+		entries = append(entries, e)
+	}
+	if err := s.Err(); err != nil {
+		return entries, errors.Wrap(err, "failed to read transcript")
+	}
+	return entries, nil
+}
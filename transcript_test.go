@@ -0,0 +1,73 @@
+package agi
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestTranscript(t *testing.T) {
+	a, f := newFakeSession(t, "agi_channel", "SIP/100")
+
+	var buf bytes.Buffer
+	a.SetTranscript(&buf)
+
+	go func() {
+		for i := 0; i < 20; i++ {
+			f.expect("GET VARIABLE FOO")
+			f.reply("200 result=1 (bar)")
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		if _, err := a.Get("FOO"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a.SetTranscript(nil)
+
+	entries, err := ReadTranscript(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []TranscriptEntry{
+		{Direction: FromAsterisk, Line: "agi_network: yes"},
+		{Direction: FromAsterisk, Line: "agi_channel: SIP/100"},
+		{Direction: FromAsterisk, Line: ""},
+	}
+	for i := 0; i < 20; i++ {
+		want = append(want,
+			TranscriptEntry{Direction: ToAsterisk, Line: "GET VARIABLE FOO"},
+			TranscriptEntry{Direction: FromAsterisk, Line: "200 result=1 (bar)"},
+		)
+	}
+	if len(entries) != len(want) {
+		t.Fatalf("read %d entries, want %d", len(entries), len(want))
+	}
+	for i, e := range entries {
+		if e.Direction != want[i].Direction || e.Line != want[i].Line {
+			t.Errorf("entry %d = %c %q, want %c %q", i, e.Direction, e.Line, want[i].Direction, want[i].Line)
+		}
+		if e.Time.IsZero() || (i > 0 && e.Time.Before(entries[i-1].Time)) {
+			t.Errorf("entry %d time %v out of order", i, e.Time)
+		}
+	}
+}
+
+func TestReadTranscriptErrors(t *testing.T) {
+	for _, in := range []string{
+		"",
+		"# agi-transcript 2\n",
+		transcriptMagic + "\n2026-01-02T15:04:05Z ? NOOP\n",
+		transcriptMagic + "\nyesterday > NOOP\n",
+	} {
+		if _, err := ReadTranscript(strings.NewReader(in)); err == nil {
+			t.Errorf("ReadTranscript(%q) succeeded", in)
+		}
+	}
+
+	entries, err := ReadTranscript(strings.NewReader(transcriptMagic + "\n# a comment\n2026-01-02T15:04:05Z >\n"))
+	if err != nil || len(entries) != 1 || entries[0].Direction != ToAsterisk || entries[0].Line != "" {
+		t.Errorf("entries = %+v, %v", entries, err)
+	}
+}
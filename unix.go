@@ -0,0 +1,106 @@
+package agi
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// listenFDsStart is the first file descriptor passed by systemd socket
+// activation
+const listenFDsStart = 3
+
+// ListenUnix binds a Unix domain socket at the given path and sets its
+// permissions to mode.  A stale socket left at the path by a previous process
+// is removed; one which is still accepting connections is not.  The socket is
+// removed when the listener is closed.
+func ListenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if c, err := net.Dial("unix", path); err == nil {
+			c.Close() // nolint: errcheck
+			return nil, errors.Errorf("socket %s is in use", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, errors.Wrap(err, "failed to remove stale socket")
+		}
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to bind socket")
+	}
+
+	if err := os.Chmod(path, mode); err != nil {
+		l.Close() // nolint: errcheck
+		return nil, errors.Wrap(err, "failed to set socket permissions")
+	}
+	return l, nil
+}
+
+// ListenAndServeUnix binds a Unix domain socket at the given path, with the
+// given permissions (see ListenUnix), and then calls Serve.  It always returns
+// a non-nil error; after Shutdown or Close, ErrServerClosed.
+func (s *Server) ListenAndServeUnix(path string, mode os.FileMode) error {
+	if s.shuttingDown() {
+		return ErrServerClosed
+	}
+
+	l, err := ListenUnix(path, mode)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// SystemdListeners returns the listeners passed to this process by systemd
+// socket activation, as described by the LISTEN_PID and LISTEN_FDS
+// environment variables, in the order of the socket unit's ListenStream
+// entries.  It returns no listeners, and no error, if the process was not
+// socket-activated.  The variables are then unset, so that they are not
+// inherited by child processes.
+func SystemdListeners() ([]net.Listener, error) {
+	defer func() {
+		os.Unsetenv("LISTEN_PID")     // nolint: errcheck
+		os.Unsetenv("LISTEN_FDS")     // nolint: errcheck
+		os.Unsetenv("LISTEN_FDNAMES") // nolint: errcheck
+	}()
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil, nil
+	}
+
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	var listeners []net.Listener
+	for i := 0; i < n; i++ {
+		fd := listenFDsStart + i
+
+		name := "LISTEN_FD_" + strconv.Itoa(fd)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+
+		// FileListener duplicates the descriptor, so the original is
+		// closed here either way.
+		f := os.NewFile(uintptr(fd), name)
+		l, err := net.FileListener(f)
+		f.Close() // nolint: errcheck
+		if err != nil {
+			for _, l := range listeners {
+				l.Close() // nolint: errcheck
+			}
+			return nil, errors.Wrapf(err, "inherited file descriptor %d (%s) is not a listener", fd, name)
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
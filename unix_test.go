@@ -0,0 +1,209 @@
+package agi
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestListenUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "agi.sock")
+
+	l, err := ListenUnix(path, 0660)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := fi.Mode().Perm(); perm != 0660 {
+		t.Errorf("socket permissions = %v, want %v", perm, os.FileMode(0660))
+	}
+
+	// A socket still in use is left alone
+	if _, err := ListenUnix(path, 0660); err == nil || !strings.Contains(err.Error(), "in use") {
+		t.Errorf("ListenUnix on a live socket = %v", err)
+	}
+	c, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("live socket broken by second ListenUnix: %v", err)
+	}
+	c.Close() // nolint: errcheck
+
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Lstat(path); !os.IsNotExist(err) {
+		t.Errorf("socket not removed on close: %v", err)
+	}
+}
+
+func TestListenUnixStale(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "agi.sock")
+
+	// Leave a socket behind, as a process which crashed would
+	old, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	old.SetUnlinkOnClose(false)
+	old.Close() // nolint: errcheck
+
+	l, err := ListenUnix(path, 0600)
+	if err != nil {
+		t.Fatalf("stale socket not replaced: %v", err)
+	}
+	defer l.Close() // nolint: errcheck
+
+	c, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close() // nolint: errcheck
+}
+
+func TestListenUnixNotSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "agi.sock")
+	if err := os.WriteFile(path, []byte("data"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if l, err := ListenUnix(path, 0600); err == nil {
+		l.Close() // nolint: errcheck
+		t.Fatal("ListenUnix replaced a regular file")
+	}
+	if data, err := os.ReadFile(path); err != nil || string(data) != "data" {
+		t.Errorf("regular file changed: %q, %v", data, err)
+	}
+}
+
+func TestSystemdListenersNotActivated(t *testing.T) {
+	for name, env := range map[string][]string{
+		"unset":        nil,
+		"pid mismatch": {"LISTEN_PID", strconv.Itoa(os.Getpid() + 1), "LISTEN_FDS", "1", "LISTEN_FDNAMES", "agi"},
+		"no fds":       {"LISTEN_PID", strconv.Itoa(os.Getpid()), "LISTEN_FDS", "0"},
+	} {
+		for _, v := range []string{"LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"} {
+			t.Setenv(v, "")
+		}
+		for i := 0; i+1 < len(env); i += 2 {
+			t.Setenv(env[i], env[i+1])
+		}
+
+		ls, err := SystemdListeners()
+		if len(ls) != 0 || err != nil {
+			t.Errorf("%s: SystemdListeners = %v, %v", name, ls, err)
+		}
+		for _, v := range []string{"LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"} {
+			if _, ok := os.LookupEnv(v); ok {
+				t.Errorf("%s: %s not unset", name, v)
+			}
+		}
+	}
+}
+
+// TestSystemdListenersHelper is run as a child process by systemdListeners,
+// inheriting the descriptors to be passed as by socket activation.  Since
+// LISTEN_PID must match the child, the child sets it itself.
+func TestSystemdListenersHelper(t *testing.T) {
+	if os.Getenv("AGI_TEST_SYSTEMD_HELPER") == "" {
+		return
+	}
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid())) // nolint: errcheck
+
+	ls, err := SystemdListeners()
+	if err != nil {
+		fmt.Println("error:", err)
+		return
+	}
+	for _, l := range ls {
+		fmt.Println("listener:", l.Addr().Network(), l.Addr().String())
+	}
+	if _, ok := os.LookupEnv("LISTEN_FDS"); ok {
+		fmt.Println("error: LISTEN_FDS not unset")
+	}
+}
+
+// systemdListeners runs TestSystemdListenersHelper with the given files as
+// descriptors 3 onwards, returning the lines it reports
+func systemdListeners(t *testing.T, names string, files ...*os.File) []string {
+	t.Helper()
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestSystemdListenersHelper$")
+	cmd.Env = append(os.Environ(),
+		"AGI_TEST_SYSTEMD_HELPER=1",
+		"LISTEN_FDS="+strconv.Itoa(len(files)),
+		"LISTEN_FDNAMES="+names,
+	)
+	cmd.ExtraFiles = files
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("helper process failed: %v\n%s", err, out)
+	}
+
+	var lines []string
+	for _, line := range strings.Split(string(out), "\n") {
+		if strings.HasPrefix(line, "listener: ") || strings.HasPrefix(line, "error: ") {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+func TestSystemdListeners(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "agi.sock")
+	ul, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ul.Close() // nolint: errcheck
+	tl, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tl.Close() // nolint: errcheck
+
+	uf, err := ul.File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer uf.Close() // nolint: errcheck
+	tf, err := tl.File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tf.Close() // nolint: errcheck
+
+	// Listeners come in the order passed, with or without names
+	got := systemdListeners(t, "agi:", uf, tf)
+	want := []string{
+		"listener: unix " + path,
+		"listener: tcp " + tl.Addr().String(),
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("helper reported\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	// A descriptor which is not a listener is reported by its name
+	f, err := os.Create(filepath.Join(t.TempDir(), "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close() // nolint: errcheck
+
+	got = systemdListeners(t, "agi:broken", uf, f)
+	if len(got) != 1 || !strings.Contains(got[0], "error: inherited file descriptor 4 (broken) is not a listener") {
+		t.Errorf("helper reported %q", got)
+	}
+
+	got = systemdListeners(t, "", uf, f)
+	if len(got) != 1 || !strings.Contains(got[0], "error: inherited file descriptor 4 (LISTEN_FD_4) is not a listener") {
+		t.Errorf("helper reported %q", got)
+	}
+}
@@ -0,0 +1,136 @@
+package agi
+
+import (
+	"regexp"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// Version is a version of Asterisk, as reported in the agi_version variable
+type Version struct {
+	Major int
+	Minor int
+	Patch int
+
+	// Raw is the version string as reported by Asterisk
+	Raw string
+}
+
+// versionRegex matches the numeric part of an Asterisk version string, such
+// as "18.10.0", "certified/18.9-cert4" or "SVN-branch-1.8-r123".
+var versionRegex = regexp.MustCompile(`(\d+)\.(\d+)(?:\.(\d+))?`)
+
+// ParseVersion parses an Asterisk version string.  Development builds (such
+// as "GIT-master-abc123") carry no version number, and return an error.
+func ParseVersion(s string) (Version, error) {
+	pieces := versionRegex.FindStringSubmatch(s)
+	if pieces == nil {
+		return Version{Raw: s}, errors.Errorf("no version number in %q", s)
+	}
+
+	v := Version{Raw: s}
+	v.Major, _ = strconv.Atoi(pieces[1]) // nolint: errcheck
+	v.Minor, _ = strconv.Atoi(pieces[2]) // nolint: errcheck
+	if pieces[3] != "" {
+		v.Patch, _ = strconv.Atoi(pieces[3]) // nolint: errcheck
+	}
+	return v, nil
+}
+
+// Known indicates whether the version number is known.  It is not for
+// development builds, nor when Asterisk did not report a version.
+func (v Version) Known() bool {
+	return v.Major > 0
+}
+
+// Less indicates whether v is an earlier version than o.  Unknown versions
+// are never earlier than any other, since they are usually development builds.
+func (v Version) Less(o Version) bool {
+	if !v.Known() {
+		return false
+	}
+	if v.Major != o.Major {
+		return v.Major < o.Major
+	}
+	if v.Minor != o.Minor {
+		return v.Minor < o.Minor
+	}
+	return v.Patch < o.Patch
+}
+
+func (v Version) String() string {
+	if v.Raw != "" {
+		return v.Raw
+	}
+	return strconv.Itoa(v.Major) + "." + strconv.Itoa(v.Minor) + "." + strconv.Itoa(v.Patch)
+}
+
+// Version returns the version of the connected Asterisk, as reported in the
+// agi_version variable.  It is not Known if Asterisk did not report one (as
+// releases before 1.6 do not) or is a development build; in that case, all
+// commands are assumed to be supported.
+func (a *AGI) Version() Version {
+	return a.version
+}
+
+// version12 is the release which added the offsetms argument of CONTROL
+// STREAM FILE
+var version12 = Version{Major: 12}
+
+// checkSupported returns an error if the connected Asterisk is known to
+// predate the given command line's command, or one of the arguments given.
+//
+// Only differences between releases which report their version can be
+// checked, so commands which arrived before 1.6 (such as the SPEECH family
+// and GOSUB) are never refused.
+func (a *AGI) checkSupported(line string) error {
+	if !a.version.Known() {
+		return nil
+	}
+
+	verb := commandVerb(line)
+	spec, ok := commandSpecs[verb]
+	if !ok || len(spec.args) == 0 {
+		return nil
+	}
+
+	n := countArgs(line[len(verb):])
+	for _, arg := range spec.args {
+		if arg.index < n && a.version.Less(arg.since) {
+			return &CommandError{
+				Kind: ErrUnsupported,
+				Err:  errors.Errorf("the %s argument of %s requires Asterisk %s or later, but connected to %s", arg.name, verb, arg.since, a.version),
+			}
+		}
+	}
+	return nil
+}
+
+// countArgs counts the arguments of a command line following the command, as
+// encoded by encodeArg: separated by spaces, and double-quoted with
+// backslash escapes where necessary.
+func countArgs(s string) int {
+	var n int
+	for i := 0; i < len(s); {
+		if s[i] == ' ' {
+			i++
+			continue
+		}
+
+		n++
+		if s[i] != '"' {
+			for i < len(s) && s[i] != ' ' {
+				i++
+			}
+			continue
+		}
+		for i++; i < len(s) && s[i] != '"'; i++ {
+			if s[i] == '\\' {
+				i++
+			}
+		}
+		i++
+	}
+	return n
+}
@@ -0,0 +1,106 @@
+package agi
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestParseVersion(t *testing.T) {
+	tests := []struct {
+		in    string
+		want  Version
+		known bool
+	}{
+		{"18.10.0", Version{Major: 18, Minor: 10, Patch: 0}, true},
+		{"certified/18.9-cert4", Version{Major: 18, Minor: 9}, true},
+		{"1.6.2.24", Version{Major: 1, Minor: 6, Patch: 2}, true},
+		{"GIT-master-abc123", Version{}, false},
+		{"", Version{}, false},
+	}
+	for _, tt := range tests {
+		v, err := ParseVersion(tt.in)
+		if (err == nil) != tt.known {
+			t.Errorf("ParseVersion(%q) error = %v", tt.in, err)
+		}
+		if v.Major != tt.want.Major || v.Minor != tt.want.Minor || v.Patch != tt.want.Patch || v.Known() != tt.known {
+			t.Errorf("ParseVersion(%q) = %+v", tt.in, v)
+		}
+	}
+}
+
+func TestVersionLess(t *testing.T) {
+	v13 := Version{Major: 13, Minor: 38, Patch: 3}
+	v18 := Version{Major: 18, Minor: 2}
+
+	if !v13.Less(v18) || v18.Less(v13) || v13.Less(v13) {
+		t.Error("Less does not order known versions")
+	}
+	if (Version{}).Less(v13) {
+		t.Error("unknown version is earlier than a known one")
+	}
+}
+
+func TestSessionVersion(t *testing.T) {
+	a, _ := newFakeSession(t, "agi_version", "20.5.0")
+
+	if v := a.Version(); v.Major != 20 || v.Minor != 5 || v.String() != "20.5.0" {
+		t.Errorf("Version() = %+v", v)
+	}
+}
+
+func TestCheckSupported(t *testing.T) {
+	const (
+		withOffset    = `CONTROL STREAM FILE welcome "" 3000 # * p 1500`
+		withoutOffset = `CONTROL STREAM FILE welcome "" 3000 # * p`
+	)
+
+	a, f := newFakeSession(t, "agi_version", "11.25.3")
+
+	err := a.Command(withOffset).Err()
+	if !errors.Is(err, ErrUnsupported) {
+		t.Fatalf("got %v, want ErrUnsupported", err)
+	}
+	if !strings.Contains(err.Error(), "offsetms") || !strings.Contains(err.Error(), "11.25.3") {
+		t.Errorf("error %q does not describe the argument and version", err)
+	}
+
+	// Without the argument, the command is sent
+	go func() {
+		f.expect(withoutOffset)
+		f.reply("200 result=0 endpos=8000")
+	}()
+	if err := a.Command(withoutOffset).Err(); err != nil {
+		t.Errorf("without offsetms: %v", err)
+	}
+
+	for _, version := range []string{"13.38.3", "GIT-master-abc123"} {
+		a, f := newFakeSession(t, "agi_version", version)
+		go func() {
+			f.expect(withOffset)
+			f.reply("200 result=0 endpos=8000")
+		}()
+		if err := a.Command(withOffset).Err(); err != nil {
+			t.Errorf("on %s: %v", version, err)
+		}
+	}
+}
+
+func TestCountArgs(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int
+	}{
+		{"", 0},
+		{" welcome", 1},
+		{` welcome "" 3000`, 3},
+		{` "a b" "c \" d" e`, 3},
+		{` "a\\" b`, 2},
+	}
+	for _, tt := range tests {
+		if got := countArgs(tt.in); got != tt.want {
+			t.Errorf("countArgs(%q) = %d, want %d", tt.in, got, tt.want)
+		}
+	}
+}